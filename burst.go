@@ -0,0 +1,333 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	BURST_DEFAULT_ACCURACY      = time.Millisecond
+	BURST_MIN_SAMPLES_PER_CYCLE = 8    // fewest samples an arbitrary waveform burst renders each cycle with
+	BURST_FREQUENCY_RESOLUTION  = 0.01 // Hz, the frequency setting resolution
+)
+
+var burstMethods = []string{"auto", "gate", "arb"}
+
+// BURST emits bursts of the waveform of a channel, cycles cycles or window long,
+// every period. gate turns the outputs on and off in software, count times, arb
+// renders one burst and the idle time after it into an arbitrary waveform that is
+// played once every period until the waveform is changed. The waveform goes in slot,
+// or a slot picked by the slot allocator when slot is nil
+type BURST struct {
+	ch       uint
+	slot     *uint
+	cycles   uint
+	window   time.Duration
+	period   time.Duration
+	count    uint
+	method   string
+	accuracy time.Duration
+}
+
+// checkBurst rejects burst parameters that cannot work
+func checkBurst(data *CMDPARAMS) error {
+	durations := make(map[string]time.Duration)
+	for name, s := range map[string]*string{"period": data.Period, "window": data.Window, "accuracy": data.Accuracy} {
+		if s == nil {
+			continue
+		}
+		d, err := parseDuration(*s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("%v must be longer than 0", name)
+		}
+		durations[name] = d
+	}
+	if data.Cycles != nil && data.Window != nil {
+		return fmt.Errorf("cycles and window cannot both be given")
+	}
+	if data.Cycles != nil && *data.Cycles == 0 {
+		return fmt.Errorf("cycles must be greater than 0")
+	}
+	if data.Window != nil && data.Period != nil && durations["window"] >= durations["period"] {
+		return fmt.Errorf("the window must be shorter than the period")
+	}
+	if data.Count != nil && *data.Count == 0 {
+		return fmt.Errorf("count must be greater than 0")
+	}
+	if data.Method != nil && !stringIn(*data.Method, burstMethods) {
+		return fmt.Errorf("Unknown burst method %v, valid methods are auto, gate and arb", *data.Method)
+	}
+	return nil
+}
+
+// newBurst builds a burst from the parameters of a burst command
+func newBurst(ch uint, data *CMDPARAMS) (*BURST, error) {
+	err := checkBurst(data)
+	if err != nil {
+		return nil, err
+	}
+	burst := &BURST{
+		ch:       ch,
+		slot:     data.Slot,
+		count:    1,
+		method:   "auto",
+		accuracy: BURST_DEFAULT_ACCURACY,
+	}
+	if data.Cycles == nil && data.Window == nil {
+		return nil, fmt.Errorf("needs cycles or window")
+	}
+	burst.period, _ = parseDuration(*data.Period)
+	if data.Cycles != nil {
+		burst.cycles = *data.Cycles
+	}
+	if data.Window != nil {
+		burst.window, _ = parseDuration(*data.Window)
+	}
+	if data.Count != nil {
+		burst.count = *data.Count
+	}
+	if data.Method != nil {
+		burst.method = *data.Method
+	}
+	if data.Accuracy != nil {
+		burst.accuracy, _ = parseDuration(*data.Accuracy)
+	}
+	return burst, nil
+}
+
+// length returns how long each burst of a waveform at frequency lasts
+func (burst *BURST) length(frequency float64) time.Duration {
+	if burst.cycles > 0 {
+		return time.Duration(float64(burst.cycles) / frequency * float64(time.Second))
+	}
+	return burst.window
+}
+
+// burstSample returns the value of a classic waveform at phase, a fraction of a cycle
+func burstSample(waveform uint, phase float64, duty float64) float64 {
+	switch waveform {
+	case WAVEFORM_SQUARE:
+		if phase < duty {
+			return 1.0
+		}
+		return -1.0
+	case WAVEFORM_TRIANGLE:
+		if phase < 0.5 {
+			return 4.0*phase - 1.0
+		}
+		return 3.0 - 4.0*phase
+	case WAVEFORM_RISING_SAWTOOTH:
+		return 2.0*phase - 1.0
+	case WAVEFORM_DESCENDING_SAWTOOTH:
+		return 1.0 - 2.0*phase
+	}
+	return math.Sin(2.0 * math.Pi * phase)
+}
+
+// renderBurst renders bursts of a classic waveform at frequency into an arbitrary
+// waveform lasting period, the burst followed by silence
+func renderBurst(waveform uint, frequency float64, duty float64, on time.Duration, period time.Duration) []float64 {
+	data := make([]float64, ARB_WAVEFORM_NUM_POINTS)
+	for i := range data {
+		t := float64(i) * period.Seconds() / ARB_WAVEFORM_NUM_POINTS
+		if t < on.Seconds() {
+			_, phase := math.Modf(t * frequency)
+			data[i] = burstSample(waveform, phase, duty)
+		}
+	}
+	return data
+}
+
+// arbBurstError returns how far the edges of a burst rendered into an arbitrary waveform
+// are from where they should be, half a sample plus the error of the frequency setting
+// the period is rounded to, or an error when the burst cannot be rendered
+func (mhs5200 *MHS5200A) arbBurstError(burst *BURST, waveform uint, frequency float64) (time.Duration, error) {
+	if waveform > WAVEFORM_DESCENDING_SAWTOOTH {
+		return 0, fmt.Errorf("only the classic waveforms can be rendered into a burst")
+	}
+	arbFrequency := 1.0 / burst.period.Seconds()
+	if arbFrequency > ARB_WAVEFORM_MAX_FREQUENCY || arbFrequency < BURST_FREQUENCY_RESOLUTION {
+		return 0, fmt.Errorf("a period of %v is outside the arbitrary waveform frequency range", burst.period)
+	}
+	if samples := ARB_WAVEFORM_NUM_POINTS / (burst.period.Seconds() * frequency); samples < BURST_MIN_SAMPLES_PER_CYCLE {
+		return 0, fmt.Errorf("a %v period leaves %.3g samples per cycle of %v, at least %v are needed", burst.period, samples, mhs5200.FrequencyString(frequency), BURST_MIN_SAMPLES_PER_CYCLE)
+	}
+	rounded := math.Round(arbFrequency/BURST_FREQUENCY_RESOLUTION) * BURST_FREQUENCY_RESOLUTION
+	periodError := math.Abs(1.0/rounded - burst.period.Seconds())
+	sample := burst.period.Seconds() / ARB_WAVEFORM_NUM_POINTS
+	return time.Duration((sample/2.0 + periodError) * float64(time.Second)).Round(time.Microsecond), nil
+}
+
+// commandLatency measures how long the instrument takes to answer a command, the
+// timing error of gating the outputs in software
+func (mhs5200 *MHS5200A) commandLatency() (time.Duration, error) {
+	latency := time.Duration(0)
+	for i := 0; i < 3; i++ {
+		start := mhs5200.now()
+		_, err := mhs5200.GetOnOff()
+		if err != nil {
+			return 0, err
+		}
+		if d := mhs5200.now().Sub(start); d > latency {
+			latency = d
+		}
+	}
+	return latency.Round(time.Microsecond), nil
+}
+
+// gateBurst emits count bursts by turning the outputs on for on every period
+func (mhs5200 *MHS5200A) gateBurst(burst *BURST, on time.Duration, stats *KEYINGSTATS) error {
+	err := mhs5200.SetOnOff(false)
+	if err != nil {
+		return err
+	}
+	start := mhs5200.now()
+	for i := uint(0); i < burst.count; i++ {
+		due := start.Add(burst.period * time.Duration(i))
+		for _, edge := range []bool{true, false} {
+			if !edge {
+				due = due.Add(on)
+			}
+			if wait := due.Sub(mhs5200.now()); wait > 0 {
+				mhs5200.sleep(wait)
+			}
+			err = mhs5200.SetOnOff(edge)
+			if err != nil {
+				return err
+			}
+			stats.latency(mhs5200, due)
+		}
+		stats.symbols++
+	}
+	stats.elapsed = mhs5200.now().Sub(start)
+	return nil
+}
+
+// arbBurst renders the burst into an arbitrary waveform, selects it and sets the
+// frequency so it plays once every period
+func (mhs5200 *MHS5200A) arbBurst(burst *BURST, waveform uint, frequency float64, on time.Duration) error {
+	duty := 0.5
+	if waveform == WAVEFORM_SQUARE {
+		d, err := mhs5200.GetDutyCycle(burst.ch)
+		if err != nil {
+			return err
+		}
+		duty = d / 100.0
+	}
+	data := renderBurst(waveform, frequency, duty, on, burst.period)
+	source := fmt.Sprintf("burst of %v of %v at %v every %v", on, mhs5200.WaveformString(waveform), mhs5200.FrequencyString(frequency), burst.period)
+	var err error
+	if burst.slot == nil {
+		err = mhs5200.setNamedArbitraryWaveform(burst.ch, "burst", data, source)
+	} else {
+		err = mhs5200.setArbitraryWaveform(*burst.slot, data, source)
+		if err == nil {
+			err = mhs5200.SetWaveform(burst.ch, WAVEFORM_ARB_0+*burst.slot)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetFrequency(burst.ch, 1.0/burst.period.Seconds())
+}
+
+// burstCommand runs a burst command. auto gates the outputs when the instrument
+// answers quickly enough to meet the accuracy, and otherwise renders the burst into
+// an arbitrary waveform when that does
+func burstCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	burst, err := newBurst(state.ch(data), data)
+	if err != nil {
+		return err
+	}
+	waveform, err := state.mhs5200.GetWaveform(burst.ch)
+	if err != nil {
+		return err
+	}
+	frequency, err := state.mhs5200.GetFrequency(burst.ch)
+	if err != nil {
+		return err
+	}
+	if frequency <= 0 {
+		return fmt.Errorf("channel %v has no frequency to burst", burst.ch)
+	}
+	on := burst.length(frequency)
+	if on >= burst.period {
+		return fmt.Errorf("a burst of %v does not fit in a period of %v", on, burst.period)
+	}
+	gateError, err := state.mhs5200.commandLatency()
+	if err != nil {
+		return err
+	}
+	arbError, arbErr := state.mhs5200.arbBurstError(burst, waveform, frequency)
+	method := burst.method
+	if method == "auto" {
+		switch {
+		case gateError <= burst.accuracy:
+			method = "gate"
+		case arbErr == nil && arbError <= burst.accuracy:
+			method = "arb"
+		case arbErr != nil:
+			return fmt.Errorf("gating is accurate to %v, not %v, and %v", gateError, burst.accuracy, arbErr)
+		default:
+			return fmt.Errorf("gating is accurate to %v and an arbitrary waveform to %v, neither meets %v", gateError, arbError, burst.accuracy)
+		}
+	}
+	if method == "arb" {
+		if arbErr != nil {
+			return arbErr
+		}
+		slot := "a slot picked by the slot allocator"
+		if burst.slot != nil {
+			slot = fmt.Sprintf("slot %v", *burst.slot)
+		}
+		state.printf("Rendering a %v burst every %v into %v and playing it on channel %v at %v, accurate to %v", on, burst.period, slot, burst.ch, state.mhs5200.FrequencyString(1.0/burst.period.Seconds()), arbError)
+		return state.mhs5200.arbBurst(burst, waveform, frequency, on)
+	}
+	state.printf("Gating the outputs on for %v every %v, %v times, accurate to %v", on, burst.period, burst.count, gateError)
+	var stats KEYINGSTATS
+	err = state.mhs5200.gateBurst(burst, on, &stats)
+	if err != nil {
+		return err
+	}
+	state.printf("Gated %v bursts in %v, %v", stats.symbols, stats.elapsed.Round(time.Millisecond), stats.latencyString())
+	return nil
+}
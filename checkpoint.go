@@ -0,0 +1,218 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// CHECKPOINT_SUFFIX is appended to the script file name to name the default checkpoint file
+const CHECKPOINT_SUFFIX = ".checkpoint"
+
+var scriptCheckpointFile = "" // set by -checkpoint
+var scriptResume = false      // set by -resume
+
+// CHECKPOINTFRAME is the position in one list of commands, the script's cmds or the
+// body of a loop, branch or subroutine. Step is the index of the command, or of the
+// next command after a completed step. Iteration is the loop iteration, or branch,
+// of the command at Step and Started the start of a timed repeat
+type CHECKPOINTFRAME struct {
+	Step      int       `json:"step"`
+	Iteration uint      `json:"iteration,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+// CHECKPOINT is the progress of a script, written after every completed step so
+// an interrupted script can be resumed. Frames holds the position from the
+// script's cmds down to the list holding the last completed step, Settings the
+// last known configuration of the instrument
+type CHECKPOINT struct {
+	Script   string             `json:"script"`
+	Hash     string             `json:"hash"`
+	Time     time.Time          `json:"time"`
+	Start    time.Time          `json:"start"`
+	Steps    int                `json:"steps"`
+	Frames   []CHECKPOINTFRAME  `json:"frames"`
+	Vars     map[string]float64 `json:"vars,omitempty"`
+	Channel  uint               `json:"channel,omitempty"`
+	Slot     uint               `json:"slot,omitempty"`
+	Timeline time.Time          `json:"timeline"`
+	Settings map[string]string  `json:"settings,omitempty"`
+	Results  []SCRIPTRESULT     `json:"results,omitempty"`
+	Measured []string           `json:"measured,omitempty"`
+}
+
+// container reports whether a command runs other commands. Progress is
+// checkpointed after the commands that do not
+func (cmd *CMD) container() bool {
+	switch cmd.Cmd {
+	case "repeat", "foreach", "if", "call":
+		return true
+	}
+	return false
+}
+
+// checkpointFilename returns the checkpoint file of a script
+func checkpointFilename(scriptfile string) string {
+	if len(scriptCheckpointFile) > 0 {
+		return scriptCheckpointFile
+	}
+	return scriptfile + CHECKPOINT_SUFFIX
+}
+
+// scriptHash identifies the commands of a script, so a checkpoint is not resumed
+// into a script that has changed
+func scriptHash(script *SCRIPT) string {
+	jsn, _ := json.Marshal(script)
+	sum := sha256.Sum256(jsn)
+	return hex.EncodeToString(sum[:])
+}
+
+// resumeFrame returns the position to resume the list of commands at level at,
+// or nil when the script is not being resumed
+func (player *SCRIPTPLAYER) resumeFrame(level int) *CHECKPOINTFRAME {
+	if player.resume == nil || level >= len(player.resume) {
+		return nil
+	}
+	return &player.resume[level]
+}
+
+// saveCheckpoint saves the progress of the script. The file is replaced atomically so
+// a crash while writing leaves the previous checkpoint intact
+func (player *SCRIPTPLAYER) saveCheckpoint() {
+	player.steps++
+	if len(player.checkpointFile) == 0 {
+		return
+	}
+	cp := CHECKPOINT{
+		Script:   player.scriptfile,
+		Hash:     player.hash,
+		Time:     player.mhs5200.now(),
+		Start:    player.start,
+		Steps:    player.steps,
+		Frames:   player.frames,
+		Vars:     player.vars,
+		Channel:  player.state.channel,
+		Slot:     player.state.slot,
+		Timeline: player.state.timeline,
+		Settings: player.mhs5200.Settings(),
+		Results:  player.results,
+		Measured: player.measured,
+	}
+	jsn, err := json.MarshalIndent(cp, "", "\t")
+	if err == nil {
+		tmp := player.checkpointFile + ".tmp"
+		err = ioutil.WriteFile(tmp, jsn, 0644)
+		if err == nil {
+			err = os.Rename(tmp, player.checkpointFile)
+		}
+	}
+	if err != nil {
+		goutils.Log.Printf("%v: %v", goutils.Funcname(), err)
+	}
+}
+
+// loadCheckpoint prepares the player to continue the script from its checkpoint.
+// Times are shifted by how long the script was stopped, so at offsets, timed
+// repeats and compensated delays carry on from where they were
+func (player *SCRIPTPLAYER) loadCheckpoint() error {
+	jsn, err := ioutil.ReadFile(player.checkpointFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No checkpoint %v to resume from", player.checkpointFile)
+		}
+		return err
+	}
+	var cp CHECKPOINT
+	err = json.Unmarshal(jsn, &cp)
+	if err != nil {
+		return fmt.Errorf("%v: %v", player.checkpointFile, err)
+	}
+	if cp.Hash != player.hash {
+		return fmt.Errorf("%v has changed since checkpoint %v was written", player.scriptfile, player.checkpointFile)
+	}
+	if len(cp.Frames) == 0 {
+		return fmt.Errorf("%v: no position to resume from", player.checkpointFile)
+	}
+	shift := player.mhs5200.now().Sub(cp.Time)
+	for i := range cp.Frames {
+		if !cp.Frames[i].Started.IsZero() {
+			cp.Frames[i].Started = cp.Frames[i].Started.Add(shift)
+		}
+	}
+	player.resume = cp.Frames
+	player.steps = cp.Steps
+	player.start = cp.Start.Add(shift)
+	player.vars = cp.Vars
+	if player.vars == nil {
+		player.vars = make(map[string]float64)
+	}
+	player.results = cp.Results
+	player.measured = cp.Measured
+	player.state.channel = cp.Channel
+	player.state.slot = cp.Slot
+	if !cp.Timeline.IsZero() {
+		player.state.timeline = cp.Timeline.Add(shift)
+	}
+	fmt.Printf("%v: Resuming %v after step %v, checkpointed %v\n", timestampString(), player.scriptfile, cp.Steps, cp.Time.Format(time.Stamp))
+	fmt.Printf("%v: Restoring the instrument configuration\n", timestampString())
+	return player.mhs5200.RestoreSettings(cp.Settings)
+}
+
+// finishCheckpoint removes the checkpoint of a script that ran to its end, or
+// tells how to resume one that was stopped by an error
+func (player *SCRIPTPLAYER) finishCheckpoint(err error) {
+	if len(player.checkpointFile) == 0 {
+		return
+	}
+	if err == nil || err == errFatalAssert {
+		rerr := os.Remove(player.checkpointFile)
+		if rerr != nil && !os.IsNotExist(rerr) {
+			goutils.Log.Printf("%v: %v", goutils.Funcname(), rerr)
+		}
+		return
+	}
+	if _, serr := os.Stat(player.checkpointFile); serr == nil {
+		fmt.Printf("%v: Progress saved in %v, use -resume to continue after step %v\n", timestampString(), player.checkpointFile, player.steps)
+	}
+}
@@ -0,0 +1,911 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// COMMANDSTATE is carried from one command to the next, on the command line and in
+// scripts. channel and slot are the channel and arbitrary waveform slot selected
+// by the channel and slot commands, player is nil on the command line. When
+// compensate is set delays are kept on the timeline, the time the previous delay
+// or scheduled step should have ended
+type COMMANDSTATE struct {
+	mhs5200    *MHS5200A
+	channel    uint
+	slot       uint
+	player     *SCRIPTPLAYER
+	compensate bool
+	timeline   time.Time
+	autoRamp   time.Duration // ramp the amplitude on on and off, 0 switches straight away
+}
+
+// COMMAND is a command shared by the command line and scripts, so both always
+// support the same commands. Args are the json names of the CMDPARAMS the command
+// line takes, in order, and Options those it takes as trailing --name value
+// options. Keywords are options that may also be given as name value, without the
+// dashes, they must not be command names. A script must give the Args too, unless Optional is set or Required
+// lists them instead, A|B meaning either A or B. Check, when set, rejects bad
+// parameters before anything runs. Run is called once per data entry of a script
+// command
+type COMMAND struct {
+	Name        string
+	Section     string // commands of a section are listed together by usage
+	Usage       string
+	Args        []string
+	Options     []string
+	Keywords    []string
+	Required    []string
+	Optional    bool
+	Transforms  bool // takes trailing --transform options on the command line
+	Offline     bool // runs without an instrument
+	ScriptOnly  bool
+	CommandOnly bool
+	WritesFile  bool // the file parameter is written to, not read from
+	Check       func(data *CMDPARAMS) error
+	Run         func(state *COMMANDSTATE, data *CMDPARAMS) error
+}
+
+// COMMANDCALL is a command parsed from the command line with its parameters
+type COMMANDCALL struct {
+	cmd  *COMMAND
+	data CMDPARAMS
+}
+
+var commandRegistry = []COMMAND{
+	{
+		Name:        "help",
+		Section:     "help",
+		Usage:       "help - show command usage",
+		Offline:     true,
+		CommandOnly: true, // handled by main
+	},
+
+	{
+		Name:     "showconfig",
+		Section:  "output",
+		Usage:    "showconfig - show the configuration of the current channel. Use channel to 0 to show config for all channels",
+		Optional: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.channel
+			if data.Channel != nil {
+				ch = *data.Channel
+			}
+			if ch == 0 {
+				return state.mhs5200.ShowConfig()
+			}
+			return state.mhs5200.ShowChannelConfig(ch)
+		},
+	},
+	{
+		Name:    "on",
+		Section: "output",
+		Usage:   "on - turn output on",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Output on")
+			return rampOnOff(state, true)
+		},
+	},
+	{
+		Name:    "off",
+		Section: "output",
+		Usage:   "off - turn output off",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Output off")
+			return rampOnOff(state, false)
+		},
+	},
+
+	{
+		Name:    "channel",
+		Section: "channel",
+		Usage:   "channel [1|2] - sets the channel number commands will apply to",
+		Args:    []string{"channel"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Selecting channel %v", *data.Channel)
+			err := state.mhs5200.SelectChannel(*data.Channel)
+			if err != nil {
+				return err
+			}
+			state.channel = *data.Channel
+			return nil
+		},
+	},
+	{
+		Name:    "frequency",
+		Section: "channel",
+		Usage:   "frequency N - set the frequency N Hz",
+		Args:    []string{"frequency"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v frequency to %v Hz", ch, *data.Frequency)
+			return state.mhs5200.SetFrequency(ch, *data.Frequency)
+		},
+	},
+	{
+		Name:    "waveform",
+		Section: "channel",
+		Usage:   "waveform name - set the waveform to name. Valid names are sine, square, triangle, rising sawtooth, descending sawtooth, sinc, normsinc, arbitrary0 to arbitrary15 or the name of a waveform in the library",
+		Args:    []string{"waveform"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v waveform to %v", ch, *data.Waveform)
+			return state.mhs5200.SetWaveformFromString(ch, *data.Waveform)
+		},
+	},
+	{
+		Name:    "amplitude",
+		Section: "channel",
+		Usage:   "amplitude N - set the amplitude to N Volts",
+		Args:    []string{"amplitude"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v amplitude to %v V", ch, *data.Amplitude)
+			return state.mhs5200.SetAmplitude(ch, *data.Amplitude)
+		},
+	},
+	{
+		Name:    "duty",
+		Section: "channel",
+		Usage:   "duty N - set the duty cycle to N%",
+		Args:    []string{"duty"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v duty cycle to %v%%", ch, *data.Duty)
+			return state.mhs5200.SetDutyCycle(ch, *data.Duty)
+		},
+	},
+	{
+		Name:    "offset",
+		Section: "channel",
+		Usage:   "offset N - set the DC offset to N Volts. Valid range is -120% to +120% of the configured amplitude",
+		Args:    []string{"offset"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v offset to %v V", ch, *data.Offset)
+			return state.mhs5200.SetOffset(ch, *data.Offset)
+		},
+	},
+	{
+		Name:    "phase",
+		Section: "channel",
+		Usage:   "phase N - set the phase to N°",
+		Args:    []string{"phase"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			state.logf("Setting channel %v phase to %v°", ch, *data.Phase)
+			return state.mhs5200.SetPhase(ch, uint(*data.Phase))
+		},
+	},
+	{
+		Name:    "attenuation",
+		Section: "channel",
+		Usage:   "attenuation [on|off] - configure -20dB channel attenuation",
+		Args:    []string{"attenuation"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			ch := state.ch(data)
+			if *data.Attenuation {
+				state.logf("Setting channel %v attenuation on", ch)
+				return state.mhs5200.SetAttenuation(ch, ATTENUATION_MINUS_20DB)
+			}
+			state.logf("Setting channel %v attenuation off", ch)
+			return state.mhs5200.SetAttenuation(ch, ATTENUATION_0DB)
+		},
+	},
+	{
+		Name:     "ramp",
+		Section:  "channel",
+		Usage:    "ramp param from to duration [--step N] - walk amplitude, offset or frequency from one value to another over duration, such as 10s, in steps of at most N",
+		Args:     []string{"param", "from", "to", "duration"},
+		Options:  []string{"step"},
+		Required: []string{"param", "to", "duration|rate"},
+		Check:    checkRamp,
+		Run:      rampCommand,
+	},
+	{
+		Name:    "key",
+		Section: "channel",
+		Usage:   "key type bits rate [options] - key the current channel with bits, a string of 0s and 1s, - to read them from standard input or a file holding them, at rate symbols per second. type is fsk to switch between two frequencies in Hz, ask between two amplitudes in Volts, psk between two phases in degrees, default 180 and 0, or ook to turn the outputs on and off. Options are --mark N sent for a 1, --space N sent for a 0 and --count N times to send the bits",
+		Args:    []string{"type", "bits", "rate"},
+		Options: []string{"mark", "space", "count", "channel"},
+		Check:   checkKeying,
+		Run:     keyCommand,
+	},
+	{
+		Name:     "morse",
+		Section:  "channel",
+		Usage:    "morse text [wpm N] [tone N] - send text in morse code on the current channel by turning the outputs on and off, at N words per minute, default 20, on a tone of N Hz, default 700. wpm and tone may also be given as --wpm and --tone",
+		Args:     []string{"text"},
+		Options:  []string{"wpm", "tone", "channel"},
+		Keywords: []string{"wpm", "tone"},
+		Check:    checkMorse,
+		Run:      morseCommand,
+	},
+	{
+		Name:    "dtmf",
+		Section: "channel",
+		Usage:   "dtmf digits [--duration N] [--gap N] - dial DTMF digits, 0-9, A-D, * and #, with the low tone on channel 1 and the high tone on channel 2 to be summed externally, each lasting N, default 100ms, with N of silence between them, default 100ms. Both channels are set to sine",
+		Args:    []string{"digits"},
+		Options: []string{"duration", "gap"},
+		Check:   checkDTMF,
+		Run:     dtmfCommand,
+	},
+	{
+		Name:     "burst",
+		Section:  "channel",
+		Usage:    "burst period [options] - emit bursts of the waveform of the current channel every period, such as 100ms. Options are --cycles N or --window N long bursts, --method auto|gate|arb, --accuracy N, default 1ms, --count N bursts to gate, default 1, and --slot N for arb. gate turns the outputs on and off, arb renders a burst of a classic waveform into slot N, or a slot picked by the slot allocator, and plays it until the waveform is changed, auto picks whichever meets the accuracy",
+		Args:     []string{"period"},
+		Options:  []string{"cycles", "window", "method", "accuracy", "count", "slot", "channel"},
+		Required: []string{"period", "cycles|window"},
+		Check:    checkBurst,
+		Run:      burstCommand,
+	},
+	{
+		Name:       "config",
+		Section:    "channel",
+		ScriptOnly: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			if data.Channel == nil && state.channel == 0 {
+				return fmt.Errorf("config needs a channel")
+			}
+			v := data.convertToChannelVals(state.mhs5200)
+			v.Channel = state.ch(data)
+			state.logf("Configuring channel %v", v.Channel)
+			return state.mhs5200.ApplyChannelConfig(v)
+		},
+	},
+
+	{
+		Name:    "showsweep",
+		Section: "sweep",
+		Usage:   "showsweep - show the current sweep mode configuration",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return state.mhs5200.ShowSweepConfig()
+		},
+	},
+	{
+		Name:    "sweepstart",
+		Section: "sweep",
+		Usage:   "sweepstart N - set the sweep start frequenecy to N Hz",
+		Args:    []string{"startf"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Setting sweep start to %v Hz", *data.Startf)
+			return state.mhs5200.SetSweepStart(*data.Startf)
+		},
+	},
+	{
+		Name:    "sweepend",
+		Section: "sweep",
+		Usage:   "sweepend N - set the sweep end frequenecy to N Hz",
+		Args:    []string{"endf"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Setting sweep end to %v Hz", *data.Endf)
+			return state.mhs5200.SetSweepEnd(*data.Endf)
+		},
+	},
+	{
+		Name:    "sweepduration",
+		Section: "sweep",
+		Usage:   "sweepduration N - set the sweep duration to N secs",
+		Args:    []string{"seconds"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Setting sweep duration to %v seconds", *data.Seconds)
+			return state.mhs5200.SetSweepDuration(*data.Seconds)
+		},
+	},
+	{
+		Name:    "sweeptype",
+		Section: "sweep",
+		Usage:   "sweeptype [log|linear] - set the sweep type to either log or linear",
+		Args:    []string{"type"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			t := state.mhs5200.SweepTypeStringToInt(*data.Type)
+			if t == math.MaxUint32 {
+				return fmt.Errorf("Unknown sweep type %v", *data.Type)
+			}
+			state.logf("Setting sweep type to %v", *data.Type)
+			return state.mhs5200.SetSweepType(t)
+		},
+	},
+	{
+		Name:    "sweepon",
+		Section: "sweep",
+		Usage:   "sweepon - turn sweep function on",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Sweep on")
+			return state.mhs5200.SetSweepState(true)
+		},
+	},
+	{
+		Name:    "sweepoff",
+		Section: "sweep",
+		Usage:   "sweepoff - turn sweep function off",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Sweep off")
+			return state.mhs5200.SetSweepState(false)
+		},
+	},
+	{
+		Name:       "configsweep",
+		Section:    "sweep",
+		ScriptOnly: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			// the sweep waveform and duty cycle are those of channel 1
+			err := sweepChannel(state, data)
+			if err != nil {
+				return err
+			}
+			state.logf("Configuring sweep")
+			return state.mhs5200.SetSweep(data.convertToSweepVals(state.mhs5200))
+		},
+	},
+
+	{
+		Name:       "stepsweep",
+		Section:    "sweep",
+		Usage:      "stepsweep startf endf dwell [options] - step the frequency of the current channel from startf to endf Hz in software, dwelling on each step, such as 500ms. Options are --type linear|log, --points N for a linear sweep, --decade N points per decade for a log sweep, --direction up|down|triangle, --count N passes, --measure type to read the counter at the end of each dwell and --file csv to write the readings to",
+		Args:       []string{"startf", "endf", "dwell"},
+		Options:    []string{"type", "points", "decade", "direction", "count", "measure", "file", "channel"},
+		WritesFile: true,
+		Check:      checkStepSweep("frequency"),
+		Run:        stepSweepCommand("frequency"),
+	},
+	{
+		Name:       "listsweep",
+		Section:    "sweep",
+		Usage:      "listsweep f1,f2,... dwell [options] - step the frequency of the current channel through a list of frequencies in Hz, taking the stepsweep options apart from --type, --points and --decade",
+		Args:       []string{"values", "dwell"},
+		Options:    []string{"direction", "count", "measure", "file", "channel"},
+		WritesFile: true,
+		Check:      checkStepSweep("frequency"),
+		Run:        stepSweepCommand("frequency"),
+	},
+	{
+		Name:       "levelsweep",
+		Section:    "sweep",
+		Usage:      "levelsweep from to dwell [options] - step the amplitude of the current channel from one level to another in Volts, switching the -20dB attenuator on at and below 2V. Options are --type linear|db, --points N or --step N Volts for a linear sweep, --step N dB for a sweep in dB, default 1dB, and the stepsweep --direction, --count, --measure and --file options",
+		Args:       []string{"from", "to", "dwell"},
+		Options:    []string{"type", "points", "step", "direction", "count", "measure", "file", "channel"},
+		WritesFile: true,
+		Check:      checkStepSweep("amplitude"),
+		Run:        stepSweepCommand("amplitude"),
+	},
+	{
+		Name:       "levellist",
+		Section:    "sweep",
+		Usage:      "levellist v1,v2,... dwell [options] - step the amplitude of the current channel through a list of levels in Volts, taking the listsweep options",
+		Args:       []string{"values", "dwell"},
+		Options:    []string{"direction", "count", "measure", "file", "channel"},
+		WritesFile: true,
+		Check:      checkStepSweep("amplitude"),
+		Run:        stepSweepCommand("amplitude"),
+	},
+
+	{
+		Name:    "slot",
+		Section: "arbitrary",
+		Usage:   "slot N - set the arbitrary waveform slot to write to",
+		Args:    []string{"slot"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			if *data.Slot >= ARB_WAVEFORM_NUM_SLOTS {
+				return fmt.Errorf("%v is not a valid arbitrary waveform slot", *data.Slot)
+			}
+			state.logf("Selecting arbitrary waveform slot %v", *data.Slot)
+			state.slot = *data.Slot
+			return nil
+		},
+	},
+	{
+		Name:    "arbwaveform",
+		Section: "arbitrary",
+		Usage: "arbwaveform file [transforms] - set arbitrary waveform from file. The file should contain 2048 lines, 1 sample per line in the -1.0 to 1.0 range \n" +
+			"    transforms are applied in order before the upload and can be zero or more of:\n" +
+			"      --invert, --reverse, --normalise, --dc N, --gain N, --clip N, --lowpass N (cutoff as a fraction of the sample rate), --smooth N (samples),\n" +
+			"      --window [hann|hamming|blackman|triangle], --rotate N (samples), --phase N (degrees), --repeat N, --mix file, --concat file",
+		Args:       []string{"file"},
+		Transforms: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := state.arbSlot(data)
+			state.logf("Uploading %v to slot %v", *data.File, slot)
+			return state.mhs5200.SetTransformedArbitraryWaveformFromFile(state.ch(data), slot, *data.File, data.Transforms)
+		},
+	},
+	{
+		Name:    "harmonics",
+		Section: "arbitrary",
+		Usage:   "harmonics spec - synthesise an arbitrary waveform into the current slot from a JSON list of harmonics, e.g. '[{\"n\":1,\"amp\":1.0},{\"n\":3,\"amp\":0.33,\"phase\":90}]', or a file containing one",
+		Args:    []string{"harmonics"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := state.arbSlot(data)
+			state.logf("Synthesising %v harmonics into slot %v", len(data.Harmonics), slot)
+			return state.mhs5200.SetArbitraryWaveformFromHarmonics(state.ch(data), slot, data.Harmonics, "")
+		},
+	},
+	{
+		Name:    "bandlimited",
+		Section: "arbitrary",
+		Usage:   "bandlimited name N - synthesise a band limited sine, square, triangle, rising sawtooth or descending sawtooth with harmonics up to N into the current slot",
+		Args:    []string{"shape", "order"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := state.arbSlot(data)
+			state.logf("Synthesising band limited %v, %v harmonics into slot %v", *data.Shape, *data.Order, slot)
+			return state.mhs5200.SetBandLimitedWaveform(state.ch(data), slot, *data.Shape, *data.Order)
+		},
+	},
+	{
+		Name:    "pattern",
+		Section: "arbitrary",
+		Usage:   "pattern spec - render a digital pattern described by JSON, or a file containing it, into the current slot. If a bitrate is given the frequency is set to match",
+		Args:    []string{"pattern"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := state.arbSlot(data)
+			state.logf("Rendering pattern into slot %v", slot)
+			return state.mhs5200.SetPattern(state.ch(data), slot, data.Pattern)
+		},
+	},
+	{
+		Name:       "arbpreview",
+		Section:    "arbitrary",
+		Usage:      "arbpreview file [transforms] - plot the arbitrary waveform in file as the generator will output it. Use -plotfile to also write an svg or png image",
+		Args:       []string{"file"},
+		Transforms: true,
+		Offline:    true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return previewArbitraryWaveform(*data.File, data.Transforms, plotFile)
+		},
+	},
+	{
+		Name:       "arbspectrum",
+		Section:    "arbitrary",
+		Usage:      "arbspectrum file N [transforms] - show the harmonic content, THD, crest factor and bandwidth of the arbitrary waveform in file played back at N Hz",
+		Args:       []string{"file", "frequency"},
+		Transforms: true,
+		Offline:    true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return showArbitraryWaveformSpectrum(*data.File, data.Transforms, *data.Frequency, plotFile)
+		},
+	},
+	{
+		Name:    "convert",
+		Section: "arbitrary",
+		Usage:   "convert file - print the raw samples in file normalised to the -1.0 to 1.0 range, converting old style 1024 point files to 2048 points",
+		Args:    []string{"file"},
+		Offline: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return convertWaveFile(*data.File)
+		},
+	},
+	{
+		Name:    "library",
+		Section: "arbitrary",
+		Usage:   "library - list the waveforms in the waveform library",
+		Offline: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return showWaveformLibrary()
+		},
+	},
+	{
+		Name:    "arbreserve",
+		Section: "arbitrary",
+		Usage:   "arbreserve N - stop library waveforms from ever being uploaded to slot N",
+		Args:    []string{"slot"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Reserving slot %v", *data.Slot)
+			return state.mhs5200.ReserveSlot(*data.Slot, true)
+		},
+	},
+	{
+		Name:    "arbrelease",
+		Section: "arbitrary",
+		Usage:   "arbrelease N - allow library waveforms to be uploaded to slot N again",
+		Args:    []string{"slot"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Releasing slot %v", *data.Slot)
+			return state.mhs5200.ReserveSlot(*data.Slot, false)
+		},
+	},
+	{
+		Name:    "arbfree",
+		Section: "arbitrary",
+		Usage:   "arbfree N - let library waveforms be uploaded to slot N although the slot registry does not know what it holds",
+		Args:    []string{"slot"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			state.logf("Freeing slot %v", *data.Slot)
+			return state.mhs5200.FreeSlot(*data.Slot, true)
+		},
+	},
+	{
+		Name:    "arblist",
+		Section: "arbitrary",
+		Usage:   "arblist - list the arbitrary waveforms recorded in the slot registry for the connected unit",
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			return state.mhs5200.ShowArbitraryWaveformSlots()
+		},
+	},
+	{
+		Name:       "arbdump",
+		Section:    "arbitrary",
+		Usage:      "arbdump N file - write the arbitrary waveform recorded for slot N to file, in the same format arbwaveform reads",
+		Args:       []string{"slot", "file"},
+		WritesFile: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			if state.mhs5200.sim != nil { // nothing was really uploaded
+				state.logf("Skipping dump of slot %v to %v", *data.Slot, *data.File)
+				return nil
+			}
+			state.logf("Dumping slot %v to %v", *data.Slot, *data.File)
+			return state.mhs5200.DumpArbitraryWaveform(*data.Slot, *data.File)
+		},
+	},
+
+	{
+		Name:     "measure",
+		Section:  "measure",
+		Usage:    "measure cmd - measure values from waveform on ext-input. cmd can be one of frequency, count, period, pulsewidth, duty, negativepulsewidth, stop",
+		Args:     []string{"type"},
+		Required: []string{"type|var"},
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			if data.Var != nil {
+				if state.player == nil {
+					return fmt.Errorf("measure into a variable only works in scripts")
+				}
+				return state.player.measure(*data)
+			}
+			return state.mhs5200.Measure(*data.Type)
+		},
+	},
+
+	{
+		Name:     "sleep",
+		Section:  "delay",
+		Usage:    "sleep N - delay N seconds before executing the next command",
+		Args:     []string{"seconds"},
+		Optional: true,
+		Run:      sleepCommand,
+	},
+	{
+		Name:     "delay",
+		Section:  "delay",
+		Usage:    "delay N - delay N seconds before executing the next command",
+		Args:     []string{"seconds"},
+		Optional: true,
+		Run:      sleepCommand,
+	},
+
+	{
+		Name:     "save",
+		Section:  "memory",
+		Usage:    "save N - save current configuration to slot N",
+		Args:     []string{"slot"},
+		Optional: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := uint(0)
+			if data.Slot != nil {
+				slot = *data.Slot
+			}
+			state.logf("Saving to slot %v", slot)
+			return state.mhs5200.Save(slot)
+		},
+	},
+	{
+		Name:     "load",
+		Section:  "memory",
+		Usage:    "load N - load current configuration from slot N",
+		Args:     []string{"slot"},
+		Optional: true,
+		Run: func(state *COMMANDSTATE, data *CMDPARAMS) error {
+			slot := uint(0)
+			if data.Slot != nil {
+				slot = *data.Slot
+			}
+			state.logf("Loading from slot %v", slot)
+			return state.mhs5200.Load(slot)
+		},
+	},
+}
+
+// findCommand returns the registered command called name, or nil
+func findCommand(name string) *COMMAND {
+	for i := range commandRegistry {
+		if commandRegistry[i].Name == name {
+			return &commandRegistry[i]
+		}
+	}
+	return nil
+}
+
+// required returns the parameters a script must give the command
+func (c *COMMAND) required() []string {
+	if c.Required != nil {
+		return c.Required
+	}
+	if c.Optional {
+		return nil
+	}
+	return c.Args
+}
+
+// checkRequired returns an error if data lacks a parameter the command needs
+func (c *COMMAND) checkRequired(data *CMDPARAMS) error {
+	for _, required := range c.required() {
+		found := false
+		for _, alternative := range strings.Split(required, "|") {
+			found = found || data.has(alternative)
+		}
+		if !found {
+			return fmt.Errorf("%v needs %v", c.Name, strings.Replace(required, "|", " or ", -1))
+		}
+	}
+	return nil
+}
+
+// sleepCommand waits for the given number of seconds, 1 second if none is given
+func sleepCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	seconds := uint(1)
+	if data.Seconds != nil {
+		seconds = *data.Seconds
+	}
+	state.printf("Sleeping for %v seconds", seconds)
+	state.wait(time.Duration(seconds) * time.Second)
+	return nil
+}
+
+// sweepChannel rejects sweep commands for a channel other than 1, the only
+// channel sweeps work on, whether given in their data or selected with channel
+func sweepChannel(state *COMMANDSTATE, data *CMDPARAMS) error {
+	if ch := state.ch(data); ch != 1 {
+		return fmt.Errorf("sweeps only work on channel 1, not channel %v", ch)
+	}
+	return nil
+}
+
+// ch returns the channel a command applies to, the channel in its data, else the
+// selected channel, else channel 1
+func (state *COMMANDSTATE) ch(data *CMDPARAMS) uint {
+	if data.Channel != nil {
+		return *data.Channel
+	}
+	if state.channel != 0 {
+		return state.channel
+	}
+	return 1
+}
+
+// arbSlot returns the arbitrary waveform slot a command writes to, the slot in its
+// data or else the selected slot
+func (state *COMMANDSTATE) arbSlot(data *CMDPARAMS) uint {
+	if data.Slot != nil {
+		return *data.Slot
+	}
+	return state.slot
+}
+
+// printf prints a message, timestamped in scripts
+func (state *COMMANDSTATE) printf(format string, a ...interface{}) {
+	if state.player != nil {
+		fmt.Printf("%v: %v\n", timestampString(), fmt.Sprintf(format, a...))
+	} else {
+		fmt.Printf(format+"\n", a...)
+	}
+}
+
+// logf prints the progress of a script, commands on the command line run quietly
+func (state *COMMANDSTATE) logf(format string, a ...interface{}) {
+	if state.player != nil {
+		state.printf(format, a...)
+	}
+}
+
+// paramField returns the CMDPARAMS field with the json name, or an invalid value
+func (params *CMDPARAMS) paramField(name string) reflect.Value {
+	v := reflect.ValueOf(params).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// has reports whether the parameter with the json name is set
+func (params *CMDPARAMS) has(name string) bool {
+	f := params.paramField(name)
+	if !f.IsValid() {
+		return false
+	}
+	switch f.Kind() {
+	case reflect.Ptr:
+		return !f.IsNil()
+	case reflect.Slice:
+		return f.Len() > 0
+	}
+	return false
+}
+
+// setArg sets the parameter with the json name from a command line argument
+func (params *CMDPARAMS) setArg(name string, arg string) error {
+	f := params.paramField(name)
+	if !f.IsValid() {
+		return fmt.Errorf("Unknown parameter %v", name)
+	}
+	switch p := f.Addr().Interface().(type) {
+	case **float64:
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return err
+		}
+		*p = &v
+	case **uint:
+		v, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return err
+		}
+		u := uint(v)
+		*p = &u
+	case **string:
+		*p = &arg
+	case *[]float64:
+		for _, s := range strings.Split(arg, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return err
+			}
+			*p = append(*p, v)
+		}
+	case **bool:
+		var v bool
+		switch arg {
+		case "on", "true":
+			v = true
+		case "off", "false":
+			v = false
+		default:
+			return fmt.Errorf("Unknown parameter %v", arg)
+		}
+		*p = &v
+	case *[]HARMONIC:
+		v, err := parseHarmonics(arg)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case **PATTERN:
+		v, err := parsePattern(arg)
+		if err != nil {
+			return err
+		}
+		*p = v
+	default:
+		return fmt.Errorf("%v cannot be given on the command line", name)
+	}
+	return nil
+}
+
+// parseCommandLine parses the whole command line before anything runs, so a
+// mistake anywhere is reported before the generator is touched
+func parseCommandLine(args []string) ([]COMMANDCALL, error) {
+	calls := make([]COMMANDCALL, 0)
+	for i := 0; i < len(args); i++ {
+		c := findCommand(args[i])
+		if c == nil {
+			return nil, fmt.Errorf("Unknown command %v", args[i])
+		}
+		if c.ScriptOnly {
+			return nil, fmt.Errorf("%v is only available in scripts", c.Name)
+		}
+		call := COMMANDCALL{cmd: c}
+		for _, name := range c.Args {
+			i++
+			if i >= len(args) {
+				return nil, fmt.Errorf("Not enough parameters for %v command", c.Name)
+			}
+			err := call.data.setArg(name, args[i])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", c.Name, err)
+			}
+		}
+		for i+2 < len(args) && ((strings.HasPrefix(args[i+1], "--") && stringIn(strings.TrimPrefix(args[i+1], "--"), c.Options)) || stringIn(args[i+1], c.Keywords)) {
+			err := call.data.setArg(strings.TrimPrefix(args[i+1], "--"), args[i+2])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", c.Name, err)
+			}
+			i += 2
+		}
+		if c.Transforms {
+			transforms, n, err := parseTransforms(args[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", c.Name, err)
+			}
+			call.data.Transforms = transforms
+			i += n
+		}
+		if c.Check != nil {
+			err := c.Check(&call.data)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", c.Name, err)
+			}
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// commandUsage lists the command line commands of the registry, a section at a time
+func commandUsage() {
+	section := ""
+	for _, c := range commandRegistry {
+		if c.ScriptOnly {
+			continue
+		}
+		if len(section) > 0 && c.Section != section {
+			fmt.Printf("\n")
+		}
+		section = c.Section
+		fmt.Printf("  %v\n", c.Usage)
+	}
+	fmt.Printf("\n")
+}
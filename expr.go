@@ -0,0 +1,446 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EXPRPARSER is a recursive descent parser for the arithmetic expressions used in
+// scripts. It supports + - * / % ^, parentheses, unary minus, variables, a small
+// set of math functions, and the comparison and logical operators < <= > >= == !=
+// && || ! which evaluate to 1 for true and 0 for false
+type EXPRPARSER struct {
+	src  string
+	pos  int
+	vars map[string]float64
+}
+
+var exprFunctions = map[string]func(args []float64) (float64, error){
+	"abs":   exprFunction1(math.Abs),
+	"sqrt":  exprFunction1(math.Sqrt),
+	"exp":   exprFunction1(math.Exp),
+	"log":   exprFunction1(math.Log),
+	"log10": exprFunction1(math.Log10),
+	"sin":   exprFunction1(math.Sin),
+	"cos":   exprFunction1(math.Cos),
+	"floor": exprFunction1(math.Floor),
+	"ceil":  exprFunction1(math.Ceil),
+	"round": exprFunction1(math.Round),
+	"pow": func(args []float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("pow takes 2 arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("min needs at least 1 argument")
+		}
+		v := args[0]
+		for _, a := range args[1:] {
+			v = math.Min(v, a)
+		}
+		return v, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("max needs at least 1 argument")
+		}
+		v := args[0]
+		for _, a := range args[1:] {
+			v = math.Max(v, a)
+		}
+		return v, nil
+	},
+}
+
+// errExprDivisionByZero lets script validation tell a division by a placeholder
+// value of zero apart from real errors
+var errExprDivisionByZero = errors.New("division by zero")
+
+var exprConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+func exprFunction1(f func(float64) float64) func(args []float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("function takes 1 argument")
+		}
+		return f(args[0]), nil
+	}
+}
+
+// evalExpression evaluates an arithmetic expression using the given variables
+func evalExpression(src string, vars map[string]float64) (float64, error) {
+	p := EXPRPARSER{
+		src:  src,
+		vars: vars,
+	}
+	v, err := p.or()
+	if err != nil {
+		return 0, fmt.Errorf("%w in expression \"%v\"", err, src)
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return 0, fmt.Errorf("unexpected \"%v\" in expression \"%v\"", p.src[p.pos:], src)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("expression \"%v\" is not a number", src)
+	}
+	return v, nil
+}
+
+func (p *EXPRPARSER) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes c if it is the next non space character
+func (p *EXPRPARSER) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptOp consumes the operator op if it is next, but not if it is the start of
+// a longer operator such as <= when looking for <
+func (p *EXPRPARSER) acceptOp(op string) bool {
+	p.skipSpace()
+	if !strings.HasPrefix(p.src[p.pos:], op) {
+		return false
+	}
+	if len(op) == 1 && p.pos+1 < len(p.src) && p.src[p.pos+1] == '=' {
+		return false
+	}
+	p.pos += len(op)
+	return true
+}
+
+func exprBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// or = and { "||" and }
+func (p *EXPRPARSER) or() (float64, error) {
+	v, err := p.and()
+	if err != nil {
+		return 0, err
+	}
+	for p.acceptOp("||") {
+		w, err := p.and()
+		if err != nil {
+			return 0, err
+		}
+		v = exprBool(v != 0 || w != 0)
+	}
+	return v, nil
+}
+
+// and = comparison { "&&" comparison }
+func (p *EXPRPARSER) and() (float64, error) {
+	v, err := p.comparison()
+	if err != nil {
+		return 0, err
+	}
+	for p.acceptOp("&&") {
+		w, err := p.comparison()
+		if err != nil {
+			return 0, err
+		}
+		v = exprBool(v != 0 && w != 0)
+	}
+	return v, nil
+}
+
+// comparison = expression [ ("<"|"<="|">"|">="|"=="|"!=") expression ]
+func (p *EXPRPARSER) comparison() (float64, error) {
+	v, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		if !p.acceptOp(op) {
+			continue
+		}
+		w, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "<=":
+			return exprBool(v <= w), nil
+		case ">=":
+			return exprBool(v >= w), nil
+		case "==":
+			return exprBool(v == w), nil
+		case "!=":
+			return exprBool(v != w), nil
+		case "<":
+			return exprBool(v < w), nil
+		case ">":
+			return exprBool(v > w), nil
+		}
+	}
+	return v, nil
+}
+
+// expression = term { ("+"|"-") term }
+func (p *EXPRPARSER) expression() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v += w
+		case p.accept('-'):
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+// term = unary { ("*"|"/"|"%") unary }
+func (p *EXPRPARSER) term() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('*'):
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			v *= w
+		case p.accept('/'):
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			if w == 0 {
+				return 0, errExprDivisionByZero
+			}
+			v /= w
+		case p.accept('%'):
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			if w == 0 {
+				return 0, errExprDivisionByZero
+			}
+			v = math.Mod(v, w)
+		default:
+			return v, nil
+		}
+	}
+}
+
+// unary = ("-"|"+"|"!") unary | power
+func (p *EXPRPARSER) unary() (float64, error) {
+	if p.acceptOp("!") {
+		v, err := p.unary()
+		return exprBool(v == 0), err
+	}
+	if p.accept('-') {
+		v, err := p.unary()
+		return -v, err
+	}
+	if p.accept('+') {
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power = primary [ "^" unary ], right associative
+func (p *EXPRPARSER) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, w)
+	}
+	return v, nil
+}
+
+// primary = number | "(" or ")" | name | name "(" or { "," or } ")"
+func (p *EXPRPARSER) primary() (float64, error) {
+	if p.accept('(') {
+		v, err := p.or()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, fmt.Errorf("missing )")
+		}
+		return v, nil
+	}
+	p.skipSpace()
+	start := p.pos
+	if p.pos >= len(p.src) {
+		return 0, fmt.Errorf("unexpected end")
+	}
+	c := p.src[p.pos]
+	if c == '.' || (c >= '0' && c <= '9') {
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+				p.pos++
+			}
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %v", p.src[start:p.pos])
+		}
+		return v, nil
+	}
+	if !validVariableName(string(c)) {
+		return 0, fmt.Errorf("unexpected \"%v\"", p.src[p.pos:])
+	}
+	for p.pos < len(p.src) && validVariableName(p.src[start:p.pos+1]) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if p.accept('(') {
+		f, ok := exprFunctions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function %v", name)
+		}
+		var args []float64
+		if !p.accept(')') {
+			for {
+				v, err := p.or()
+				if err != nil {
+					return 0, err
+				}
+				args = append(args, v)
+				if p.accept(')') {
+					break
+				}
+				if !p.accept(',') {
+					return 0, fmt.Errorf("missing ) after arguments to %v", name)
+				}
+			}
+		}
+		v, err := f(args)
+		if err != nil {
+			return 0, fmt.Errorf("%v: %v", name, err)
+		}
+		return v, nil
+	}
+	if v, ok := p.vars[name]; ok {
+		return v, nil
+	}
+	if v, ok := exprConstants[name]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("undefined variable %v", name)
+}
+
+// validVariableName reports whether name can be used as a script variable
+func validVariableName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// expandExpressions replaces ${expr} in a string with the value of expr
+func expandExpressions(s string, vars map[string]float64) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			return "", fmt.Errorf("missing } in \"%v\"", s)
+		}
+		v, err := evalExpression(s[i+2:i+j], vars)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(s[:i])
+		out.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		s = s[i+j+1:]
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestEvalExpression(t *testing.T) {
+	vars := map[string]float64{"x": 3, "y": 0.5}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"42", 42},
+		{"1.5e3", 1500},
+		{".25", 0.25},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 / 4", 2.5},
+		{"7 % 4", 3},
+		{"8 - 2 - 1", 5},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"--3", 3},
+		{"+3", 3},
+		{"x * 2 + y", 6.5},
+		{"pi", math.Pi},
+		{"e", math.E},
+		{"abs(-2)", 2},
+		{"sqrt(16)", 4},
+		{"round(2.5)", 3},
+		{"floor(-1.5)", -2},
+		{"pow(2, 10)", 1024},
+		{"min(4)", 4},
+		{"max(1, x, 2)", 3},
+		{"1 < 2", 1},
+		{"2 <= 1", 0},
+		{"2 > 1", 1},
+		{"1 >= 1", 1},
+		{"x == 3", 1},
+		{"x != 3", 0},
+		{"1 + 1 == 2", 1},
+		{"1 < 2 && 2 < 1", 0},
+		{"1 < 2 || 2 < 1", 1},
+		{"0 || 0 && 1", 0},
+		{"1 || 0 && 0", 1},
+		{"!0", 1},
+		{"!(x == 3)", 0},
+		{"!x", 0},
+		{" ( x + 1 ) * ( x - 1 ) ", 8},
+	}
+	for _, test := range tests {
+		got, err := evalExpression(test.src, vars)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%q = %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestEvalExpressionErrors(t *testing.T) {
+	vars := map[string]float64{"x": 3}
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"1 )",
+		"z",
+		"foo(1)",
+		"pow(1)",
+		"max()",
+		"sqrt(1, 2)",
+		"min(1 2)",
+		"sqrt(-1)",
+		"log(0)",
+		"#",
+	}
+	for _, src := range tests {
+		if v, err := evalExpression(src, vars); err == nil {
+			t.Errorf("%q = %v, want an error", src, v)
+		}
+	}
+	for _, src := range []string{"1 / 0", "x / (x - 3)", "5 % 0"} {
+		_, err := evalExpression(src, vars)
+		if !errors.Is(err, errExprDivisionByZero) {
+			t.Errorf("%q: got error %v, want division by zero", src, err)
+		}
+	}
+}
+
+func TestExpandExpressions(t *testing.T) {
+	vars := map[string]float64{"f": 1000, "a": 2}
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"sine", "sine"},
+		{"${a}", "2"},
+		{"${f * 2} Hz", "2000 Hz"},
+		{"${a}${a}", "22"},
+		{"a ${a} b ${a + 1} c", "a 2 b 3 c"},
+		{"${1 / 3}", "0.3333333333333333"},
+		{"${f * 1e6}", "1e+09"},
+	}
+	for _, test := range tests {
+		got, err := expandExpressions(test.s, vars)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q = %q, want %q", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"${a", "${b}", "${a +}"} {
+		if got, err := expandExpressions(s, vars); err == nil {
+			t.Errorf("%q = %q, want an error", s, got)
+		}
+	}
+}
+
+func TestValidVariableName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a", true},
+		{"_x1", true},
+		{"vpp", true},
+		{"", false},
+		{"1a", false},
+		{"a-b", false},
+		{"a b", false},
+	}
+	for _, test := range tests {
+		if got := validVariableName(test.name); got != test.want {
+			t.Errorf("validVariableName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -3,7 +3,9 @@ module github.com/peterska/go-mhs5200a
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/peterska/go-utils v1.0.3
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	golang.org/x/crypto v0.14.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,335 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+var keyingTypes = []string{"fsk", "ask", "ook", "psk"}
+
+// KEYING keys a channel from a stream of bits. A 1 sends mark and a 0 sends space,
+// frequencies for fsk, amplitudes for ask and phases for psk, while ook turns the
+// outputs on and off
+type KEYING struct {
+	ch     uint
+	typ    string
+	mark   float64
+	space  float64
+	symbol time.Duration
+}
+
+// KEYINGSTATS is how closely the symbols kept to time. Latency is measured from the
+// time a symbol should have started to when the instrument acknowledged it
+type KEYINGSTATS struct {
+	symbols      uint
+	changes      uint // symbols that differed from the previous one and were sent
+	elapsed      time.Duration
+	totalLatency time.Duration
+	maxLatency   time.Duration
+	resyncs      uint // times the schedule was restarted after falling a symbol behind
+}
+
+func (stats *KEYINGSTATS) String() string {
+	if stats.changes == 0 {
+		return fmt.Sprintf("Keyed %v symbols", stats.symbols)
+	}
+	s := fmt.Sprintf("Keyed %v symbols, %v sent, in %v, %.6g baud, %v",
+		stats.symbols, stats.changes, stats.elapsed.Round(time.Millisecond),
+		float64(stats.symbols)/stats.elapsed.Seconds(), stats.latencyString())
+	if stats.resyncs == 1 {
+		s += ", restarted the schedule once after falling behind"
+	} else if stats.resyncs > 1 {
+		s += fmt.Sprintf(", restarted the schedule %v times after falling behind", stats.resyncs)
+	}
+	return s
+}
+
+// latencyString formats the mean and largest latency of the symbols sent
+func (stats *KEYINGSTATS) latencyString() string {
+	if stats.changes == 0 {
+		return "no latency"
+	}
+	return fmt.Sprintf("latency mean %v max %v",
+		(stats.totalLatency / time.Duration(stats.changes)).Round(time.Microsecond),
+		stats.maxLatency.Round(time.Microsecond))
+}
+
+// latency records how late a symbol due at due was acknowledged
+func (stats *KEYINGSTATS) latency(mhs5200 *MHS5200A, due time.Time) {
+	latency := mhs5200.now().Sub(due)
+	stats.changes++
+	stats.totalLatency += latency
+	if latency > stats.maxLatency {
+		stats.maxLatency = latency
+	}
+}
+
+// isBits reports whether s is a string of bits, rather than a file to read them from
+func isBits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c != '0' && c != '1' && c != '_' && c != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// openBits returns the source of the bits of a key command, the bits themselves,
+// - for standard input or a file holding them
+func openBits(bits string) (io.Reader, func(), error) {
+	switch {
+	case bits == "-":
+		return os.Stdin, func() {}, nil
+	case isBits(bits):
+		return strings.NewReader(bits), func() {}, nil
+	}
+	f, err := os.Open(bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// checkKeying rejects keying parameters that cannot work
+func checkKeying(data *CMDPARAMS) error {
+	if data.Type != nil && !stringIn(*data.Type, keyingTypes) {
+		return fmt.Errorf("Unknown keying type %v, valid types are %v", *data.Type, strings.Join(keyingTypes, ", "))
+	}
+	if data.Rate != nil && *data.Rate <= 0 {
+		return fmt.Errorf("symbol rate must be greater than 0")
+	}
+	if data.Count != nil && *data.Count == 0 {
+		return fmt.Errorf("count must be greater than 0")
+	}
+	if data.Bits != nil && *data.Bits == "-" && data.Count != nil && *data.Count > 1 {
+		return fmt.Errorf("standard input cannot be keyed more than once")
+	}
+	if data.Type == nil {
+		return nil
+	}
+	switch *data.Type {
+	case "fsk":
+		if data.Mark == nil || data.Space == nil {
+			return fmt.Errorf("%v needs mark and space", *data.Type)
+		}
+	case "ask":
+		if data.Mark == nil || data.Space == nil {
+			return fmt.Errorf("%v needs mark and space", *data.Type)
+		}
+		for _, v := range []float64{*data.Mark, *data.Space} {
+			if v < 5e-3 || v > 20.0 {
+				return fmt.Errorf("%v is not a valid amplitude, ask levels are 5mV to 20V", v)
+			}
+		}
+		// above 2V the attenuator is off for both levels, setting the amplitude in 10mV steps
+		lo, hi := math.Min(*data.Mark, *data.Space), math.Max(*data.Mark, *data.Space)
+		if hi > ATTENUATED_MAX_AMPLITUDE && lo < 0.01 {
+			return fmt.Errorf("ask levels %vV and %vV are either side of 2V, the attenuator is off for both and %vV is below its 10mV resolution", *data.Mark, *data.Space, lo)
+		}
+	case "psk":
+		for _, v := range []*float64{data.Mark, data.Space} {
+			if v != nil && (*v < 0 || *v > 360) {
+				return fmt.Errorf("%v is not a valid phase", *v)
+			}
+		}
+	}
+	return nil
+}
+
+// newKeying builds a keying from the parameters of a key command, psk defaults to
+// 180° for mark and 0° for space
+func newKeying(ch uint, data *CMDPARAMS) (*KEYING, error) {
+	err := checkKeying(data)
+	if err != nil {
+		return nil, err
+	}
+	k := &KEYING{
+		ch:     ch,
+		typ:    *data.Type,
+		mark:   1.0,
+		symbol: time.Duration(float64(time.Second) / *data.Rate),
+	}
+	if k.typ == "psk" {
+		k.mark = 180.0
+	}
+	if data.Mark != nil {
+		k.mark = *data.Mark
+	}
+	if data.Space != nil {
+		k.space = *data.Space
+	}
+	return k, nil
+}
+
+// prepare readies the channel for keying. Both symbols are checked against the limit
+// profile before anything is sent, and ask picks one attenuation for both levels by
+// setting the larger of them, so the attenuator relay does not switch on every
+// symbol when mark and space are either side of 2V
+func (k *KEYING) prepare(mhs5200 *MHS5200A) error {
+	for _, v := range []float64{k.mark, k.space} {
+		var err error
+		switch k.typ {
+		case "fsk":
+			_, err = mhs5200.limitFrequency(k.ch, v)
+		case "ask":
+			_, err = mhs5200.limitAmplitude(k.ch, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if k.typ != "ask" {
+		return nil
+	}
+	return mhs5200.SetAmplitudeAuto(k.ch, math.Max(k.mark, k.space))
+}
+
+// send sets the channel to the mark or space symbol
+func (k *KEYING) send(mhs5200 *MHS5200A, bit bool) error {
+	v := k.space
+	if bit {
+		v = k.mark
+	}
+	switch k.typ {
+	case "fsk":
+		return mhs5200.SetFrequency(k.ch, v)
+	case "ask":
+		return mhs5200.SetAmplitude(k.ch, v)
+	case "psk":
+		return mhs5200.SetPhase(k.ch, uint(math.Round(v)))
+	}
+	return mhs5200.SetOnOff(bit)
+}
+
+// Key sends the bits read from r, one symbol every symbol period. Only symbols that
+// differ from the previous one are sent. The symbols are timed from the start, and
+// when a symbol starts a whole period late, a slow instrument or a stalled input, the
+// schedule restarts from it rather than rushing to catch up
+func (mhs5200 *MHS5200A) Key(k *KEYING, r io.Reader, stats *KEYINGSTATS) error {
+	in := bufio.NewReader(r)
+	start := mhs5200.now()
+	n := 0
+	sent := false
+	last := false
+	for {
+		c, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var bit bool
+		switch c {
+		case '0':
+		case '1':
+			bit = true
+		case ' ', '\t', '\r', '\n', '_':
+			continue
+		default:
+			return fmt.Errorf("%q is not a bit", c)
+		}
+		due := start.Add(k.symbol * time.Duration(n))
+		if wait := due.Sub(mhs5200.now()); wait > 0 {
+			mhs5200.sleep(wait)
+		} else if -wait >= k.symbol {
+			stats.resyncs++
+			start = mhs5200.now()
+			due = start
+			n = 0
+		}
+		if !sent || bit != last {
+			err = k.send(mhs5200, bit)
+			if err != nil {
+				return err
+			}
+			stats.latency(mhs5200, due)
+			sent = true
+			last = bit
+		}
+		stats.symbols++
+		n++
+	}
+	// hold the last symbol for its whole period
+	if wait := start.Add(k.symbol * time.Duration(n)).Sub(mhs5200.now()); wait > 0 {
+		mhs5200.sleep(wait)
+	}
+	return nil
+}
+
+// keyCommand runs a key command, count times over unless the bits are read from
+// standard input
+func keyCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	k, err := newKeying(state.ch(data), data)
+	if err != nil {
+		return err
+	}
+	count := uint(1)
+	if data.Count != nil {
+		count = *data.Count
+	}
+	state.logf("Keying channel %v %v at %.6g baud, %v per symbol", k.ch, k.typ, *data.Rate, k.symbol)
+	err = k.prepare(state.mhs5200)
+	if err != nil {
+		return err
+	}
+	var stats KEYINGSTATS
+	start := state.mhs5200.now()
+	for i := uint(0); i < count; i++ {
+		r, done, err := openBits(*data.Bits)
+		if err != nil {
+			return err
+		}
+		err = state.mhs5200.Key(k, r, &stats)
+		done()
+		if err != nil {
+			return err
+		}
+	}
+	stats.elapsed = state.mhs5200.now().Sub(start)
+	state.printf("%v", stats.String())
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Arbitrary waveform library
+*
+* The library is a directory of named waveforms. Each waveform is stored in name.csv, in the format
+* arbwaveform reads, with optional metadata in name.json. Named waveforms are uploaded to slots picked
+* by the slot allocator, which uses the slot registry to skip uploads of waveforms that are already
+* stored on the unit and never overwrites reserved slots, slots written with the slot command or
+* slots the registry knows nothing about, which may have been filled by hand, unless freed with arbfree.
+*
+ */
+
+// waveformLibraryDir is the directory holding the waveform library
+var waveformLibraryDir = "waves"
+
+type LIBRARYWAVEFORM struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+}
+
+func validLibraryName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, `/\`) && name != "." && name != ".."
+}
+
+func libraryWaveformFilename(name string) string {
+	return filepath.Join(waveformLibraryDir, name+".csv")
+}
+
+func isLibraryWaveform(name string) bool {
+	if !validLibraryName(name) {
+		return false
+	}
+	_, err := os.Stat(libraryWaveformFilename(name))
+	return err == nil
+}
+
+func loadLibraryWaveformMetadata(name string) (*LIBRARYWAVEFORM, error) {
+	v := LIBRARYWAVEFORM{
+		Name: name,
+	}
+	jsn, err := ioutil.ReadFile(filepath.Join(waveformLibraryDir, name+".json"))
+	if os.IsNotExist(err) {
+		return &v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsn, &v)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	v.Name = name
+	return &v, nil
+}
+
+func listWaveformLibrary() ([]*LIBRARYWAVEFORM, error) {
+	files, err := filepath.Glob(filepath.Join(waveformLibraryDir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	waveforms := make([]*LIBRARYWAVEFORM, 0, len(files))
+	for _, file := range files {
+		v, err := loadLibraryWaveformMetadata(strings.TrimSuffix(filepath.Base(file), ".csv"))
+		if err != nil {
+			return nil, err
+		}
+		waveforms = append(waveforms, v)
+	}
+	return waveforms, nil
+}
+
+func showWaveformLibrary() error {
+	waveforms, err := listWaveformLibrary()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Waveform library %v\n", waveformLibraryDir)
+	for _, v := range waveforms {
+		if len(v.Description) > 0 {
+			fmt.Printf("\t%v\t- %v\n", v.Name, v.Description)
+		} else {
+			fmt.Printf("\t%v\n", v.Name)
+		}
+	}
+	return nil
+}
+
+// allocateSlot finds a slot for a named waveform, returning whether the waveform needs to be uploaded
+func (mhs5200 *MHS5200A) allocateSlot(name string, samples []int) (uint, bool, error) {
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return 0, false, err
+	}
+	unit := registry.unit(serial)
+	hash := arbitraryWaveformHash(samples)
+	for slot := uint(0); slot < ARB_WAVEFORM_NUM_SLOTS; slot++ { // already on the unit
+		if v, ok := unit.Slots[slot]; ok && v.Hash == hash {
+			return slot, false, nil
+		}
+	}
+	// fill free slots from the top, the low slots are the ones usually written by hand.
+	// The slots of the simulator start out empty
+	for slot := int(ARB_WAVEFORM_NUM_SLOTS - 1); slot >= 0; slot-- {
+		_, ok := unit.Slots[uint(slot)]
+		free := unit.isFree(uint(slot)) || (!ok && mhs5200.sim != nil)
+		if free && !unit.isReserved(uint(slot)) {
+			return uint(slot), true, nil
+		}
+	}
+	// sinc and normsinc have always been written to slot 15, keep doing so while the
+	// registry knows nothing about it rather than asking for arbfree
+	if name == WAVEFORM_SINC_STR || name == WAVEFORM_NORM_SINC_STR {
+		_, ok := unit.Slots[ARB_WAVEFORM_BUILTIN_SLOT]
+		if !ok && !unit.isReserved(ARB_WAVEFORM_BUILTIN_SLOT) {
+			return ARB_WAVEFORM_BUILTIN_SLOT, true, nil
+		}
+	}
+	// replace the least recently used library waveform
+	found := false
+	lru := uint(0)
+	var lrutime time.Time
+	for slot, v := range unit.Slots {
+		if len(v.Name) == 0 || unit.isReserved(slot) {
+			continue
+		}
+		t := v.Used
+		if v.Uploaded.After(t) {
+			t = v.Uploaded
+		}
+		if !found || t.Before(lrutime) {
+			found, lru, lrutime = true, slot, t
+		}
+	}
+	if !found {
+		return 0, false, fmt.Errorf("No arbitrary waveform slot available for %v, all slots are reserved, were written with the slot command or hold unknown contents. Use arbfree to let library waveforms use a slot", name)
+	}
+	return lru, true, nil
+}
+
+// setNamedArbitraryWaveform uploads data to a slot picked by the slot allocator, unless it is already stored, and selects it on channel ch
+func (mhs5200 *MHS5200A) setNamedArbitraryWaveform(ch uint, name string, data []float64, source string) error {
+	samples := quantiseArbitraryWaveform(data)
+	slot, upload, err := mhs5200.allocateSlot(name, samples)
+	if err != nil {
+		return err
+	}
+	if upload {
+		err = mhs5200.setArbitraryWaveform(slot, data, source)
+		if err != nil {
+			return err
+		}
+	} else if goutils.Loglevel() > 0 {
+		goutils.Log.Printf("%v is already stored in slot %v", name, slot)
+	}
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return err
+	}
+	// only slots the allocator filled are named, and so managed by it
+	if v := registry.slot(serial, slot); v != nil && (upload || len(v.Name) > 0) {
+		v.Name = name
+		v.Used = time.Now()
+		err = registry.save()
+		if err != nil {
+			goutils.Log.Printf("%v failed to update the slot registry, %v", goutils.Funcname(), err)
+		}
+	}
+	return mhs5200.SetWaveform(ch, WAVEFORM_ARB_0+slot)
+}
+
+// SetLibraryWaveform selects the library waveform name on channel ch, uploading it first if needed
+func (mhs5200 *MHS5200A) SetLibraryWaveform(ch uint, name string) error {
+	if !isLibraryWaveform(name) {
+		return fmt.Errorf("%v is not a valid waveform", name)
+	}
+	filename := libraryWaveformFilename(name)
+	data, err := loadArbitraryWaveformFile(filename)
+	if err != nil {
+		return err
+	}
+	return mhs5200.setNamedArbitraryWaveform(ch, name, data, filename)
+}
+
+// ReserveSlot stops the slot allocator from ever overwriting slot
+func (mhs5200 *MHS5200A) ReserveSlot(slot uint, reserve bool) error {
+	if slot >= ARB_WAVEFORM_NUM_SLOTS {
+		return fmt.Errorf("%v is not a valid arbitrary waveform slot", slot)
+	}
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return err
+	}
+	unit := registry.unit(serial)
+	unit.Reserved = removeSlot(unit.Reserved, slot)
+	if reserve {
+		unit.Reserved = append(unit.Reserved, slot)
+	}
+	return registry.save()
+}
+
+// FreeSlot lets the slot allocator fill slot although the slot registry does not
+// know what it holds, or stops it again
+func (mhs5200 *MHS5200A) FreeSlot(slot uint, free bool) error {
+	if slot >= ARB_WAVEFORM_NUM_SLOTS {
+		return fmt.Errorf("%v is not a valid arbitrary waveform slot", slot)
+	}
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return err
+	}
+	unit := registry.unit(serial)
+	unit.Free = removeSlot(unit.Free, slot)
+	if free {
+		unit.Free = append(unit.Free, slot)
+	}
+	return registry.save()
+}
@@ -41,8 +41,7 @@ import (
 	"github.com/peterska/go-utils"
 	"os"
 	"path"
-	"strconv"
-	"time"
+	"strings"
 )
 
 func usage() {
@@ -56,472 +55,170 @@ func usage() {
 	fmt.Printf("command can be one or more of the following:\n")
 	fmt.Printf("\n")
 
-	fmt.Printf("  help - show command usage\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  showconfig - show the configuration of the current channel. Use channel to 0 to show config for all channels\n")
-	fmt.Printf("  on - turn output on\n")
-	fmt.Printf("  off - turn output off\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  channel [1|2] - sets the channel number commands will apply to\n")
-	fmt.Printf("  frequency N - set the frequency N Hz\n")
-	fmt.Printf("  waveform name - set the waveform to name. Valid names are sine, square, triangle, rising sawtooth, descending sawtooth, sinc, normsinc\n")
-	fmt.Printf("  amplitude N - set the amplitude to N Volts\n")
-	fmt.Printf("  duty N - set the duty cycle to N%%\n")
-	fmt.Printf("  offset N - set the DC offset to N Volts. Valid range is -120%% to +120%% of the configured amplitude\n")
-	fmt.Printf("  phase N - set the phase to N°\n")
-	fmt.Printf("  attenuation [on|off] - configure -20dB channel attenuation\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  showsweep - show the current sweep mode configuration\n")
-	fmt.Printf("  sweepstart N - set the sweep start frequenecy to N Hz\n")
-	fmt.Printf("  sweepend N - set the sweep end frequenecy to N Hz\n")
-	fmt.Printf("  sweepduration N - set the sweep duration to N secs\n")
-	fmt.Printf("  sweeptype [log|linear] - set the sweep type to either log or linear\n")
-	fmt.Printf("  sweepon - turn sweep function on\n")
-	fmt.Printf("  sweepoff - turn sweep function off\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  slot N - set the arbitrary waveform slot to write to\n")
-	fmt.Printf("  arbwaveform file - set arbitrary waveform from file. The file should contain 2048 lines, 1 sample per line in the -1.0 to 1.0 range \n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  measure cmd - measure values from waveform on ext-input. cmd can be one of frequency, count, period, pulsewidth, duty, negativepulsewidth, stop\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  sleep N - delay N seconds before executing the next command\n")
-	fmt.Printf("  delay N - delay N seconds before executing the next command\n")
-	fmt.Printf("\n")
-
-	fmt.Printf("  save N - save current configuration to slot N\n")
-	fmt.Printf("  load N - load current configuration from slot N\n")
-	fmt.Printf("\n")
+	commandUsage()
 
 	fmt.Printf("Examples:\n")
 	fmt.Printf("%v channel 2 frequency 10000 phase 180 waveform square duty 33.25 attenuation off showconfig on sleep 120 off\n", path.Base(os.Args[0]))
-	fmt.Printf("%v sweepstart 10 sweepend 100000 sweepduration 60 sweetype linear showsweep sweepon delay 60 sweepoff\n", path.Base(os.Args[0]))
+	fmt.Printf("%v sweepstart 10 sweepend 100000 sweepduration 60 sweeptype linear showsweep sweepon delay 60 sweepoff\n", path.Base(os.Args[0]))
 	fmt.Printf("%v frequency 15.503 waveform square duty 50.0 on measure frequency sleep 10 measure stop off\n", path.Base(os.Args[0]))
 	fmt.Printf("%v save 10\n", path.Base(os.Args[0]))
 	fmt.Printf("%v load 10\n", path.Base(os.Args[0]))
 }
 
+// uploadProgressBar shows the progress of an arbitrary waveform upload
+func uploadProgressBar(slot uint, slice int, slices int) {
+	fmt.Printf("\rUploading slot %2d [%-*s] %d/%d", slot, slices, strings.Repeat("#", slice), slice, slices)
+	if slice == slices {
+		fmt.Printf("\n")
+	}
+}
+
 func main() {
 	var verbose = flag.Int("v", 0, "verbose level")
 	//var debug = flag.Int("debug", 0, "debug level, 0=production, >0 is devmode")
 	//var pprof = flag.Bool("pprof", false, "enable golang profling")
 	var port = flag.String("port", "/dev/ttyUSB0", "port the MHS-5200A is connected to")
-	var scriptfile = flag.String("script", "", "json script file")
+	var scriptfile = flag.String("script", "", "script file, json, yaml or toml")
+	var plotfile = flag.String("plotfile", "", "svg or png image file plots are also written to")
+	var ascii = flag.Bool("ascii", false, "draw terminal plots using ASCII instead of braille characters")
+	var library = flag.String("library", "waves", "directory holding the waveform library")
+	var pipeline = flag.Int("pipeline", ARB_WAVEFORM_PIPELINE_DEFAULT, "number of arbitrary waveform slices sent before waiting for acknowledgements, 1 disables pipelining")
+	var registry = flag.String("registry", "", "arbitrary waveform slot registry file (default is mhs5200a/slots.json in the user config directory)")
+	var junit = flag.String("junit", "", "write a JUnit XML report of the script run to this file")
+	var tap = flag.String("tap", "", "write a TAP report of the script run to this file")
+	var validate = flag.Bool("validate", false, "check the script, or the scripts of a -cron file, for errors and estimate its runtime without connecting to the MHS-5200A")
+	var dryrun = flag.Bool("dry-run", false, "print the commands that would be sent to the MHS-5200A instead of sending them")
+	var checkpoint = flag.String("checkpoint", "", "file script progress is saved to so -resume can continue it (default is the script file name with .checkpoint appended)")
+	var resume = flag.Bool("resume", false, "continue the script after the last step completed before it was stopped")
+	var safestate = flag.String("safe-state", strings.Join(safeActions, ","), "comma separated actions applied on interrupt, error or script end: off, sweep, amplitude, counter or none")
+	var profile = flag.String("profile", "", "name of the limit profile protecting the device under test, such as mcu-3v3")
+	var profiles = flag.String("profiles", "", "limit profiles file (default is mhs5200a/profiles.json in the user config directory)")
+	var autoramp = flag.String("autoramp", "", "ramp the amplitude up after on and down before off over this duration, such as 2s")
+	var cron = flag.String("cron", "", "run the scripts listed in this crontab style file on their schedules")
+	var overrides VARFLAGS
+	flag.Var(&overrides, "set", "set script variable, name=value, may be repeated")
 	flag.Parse()
 
 	//goutils.SetDebuglevel(*debug)
 	//goutils.SetProfiling(*pprof)
 	goutils.SetLoglevel(*verbose)
-
-	if len(*scriptfile) > 0 {
-		err := playbackScript(*scriptfile, *port)
+	slotRegistryFilename = *registry
+	plotASCII = *ascii
+	plotFile = *plotfile
+	waveformLibraryDir = *library
+	arbUploadPipelineDepth = *pipeline
+	scriptVarOverrides = overrides
+	scriptJUnitFile = *junit
+	scriptTAPFile = *tap
+	dryRun = *dryrun
+	scriptCheckpointFile = *checkpoint
+	scriptResume = *resume
+	actions, err := parseSafeState(*safestate)
+	if err != nil {
+		goutils.Log.Print(err)
+		os.Exit(10)
+	}
+	safeState = actions
+	profileName = *profile
+	if len(*autoramp) > 0 {
+		autoRamp, err = parseDuration(*autoramp)
 		if err != nil {
 			goutils.Log.Print(err)
 			os.Exit(10)
 		}
-		if len(flag.Args()) == 0 { // nothing to do
-			return
-		}
 	}
-	if len(flag.Args()) == 0 { // nothing to do
-		usage()
-		return
-	}
-	needparam := false
-	cmd := ""
-	param := ""
-	// process cmdline not requiring an instrument
-	for _, argv := range flag.Args() {
-		if needparam {
-			param = argv
-			needparam = false
-		} else {
-			cmd = argv
-			param = ""
-		}
-		switch cmd {
-		case "help":
-			usage()
-			return
+	profilesFilename = *profiles
+	handleInterrupts()
 
-		case "convert":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			err := convertWaveFile(param)
+	if *validate {
+		if len(*cron) > 0 {
+			err := validateCrontab(*cron, *port)
 			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
+				goutils.Log.Print(err)
 				os.Exit(10)
 			}
 			return
 		}
+		if len(*scriptfile) == 0 {
+			goutils.Log.Printf("-validate needs a -script or -cron")
+			os.Exit(10)
+		}
+		err := validateScript(*scriptfile, *port)
+		if err != nil {
+			goutils.Log.Print(err)
+			os.Exit(10)
+		}
+		return
 	}
-	if needparam {
-		goutils.Log.Printf("Not enough parameters for %v command\n", cmd)
+	if *resume && len(*scriptfile) == 0 {
+		goutils.Log.Printf("-resume needs a -script")
 		os.Exit(10)
 	}
-
-	mhs5200, err := NewMHS5200A(*port)
-	if err != nil {
-		goutils.Log.Print(err)
-		os.Exit(10)
-	}
-	if mhs5200 == nil {
+	if len(*cron) > 0 {
+		err := cronDaemon(*cron, *port)
+		if err != nil {
+			goutils.Log.Print(err)
+			os.Exit(10)
+		}
 		return
 	}
-	defer mhs5200.Close()
-	channel := uint(1)
-	slot := uint(0)
-	needparam = false
-	cmd = ""
-	param = ""
-	for _, argv := range flag.Args() {
-		if needparam {
-			param = argv
-			needparam = false
-		} else {
-			cmd = argv
-			param = ""
-		}
-		switch cmd {
-		case "channel":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			channel = uint(v)
-			err = mhs5200.SelectChannel(channel)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "slot":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			slot = uint(v)
-
-		case "sleep":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			fmt.Printf("Sleeping for %v seconds\n", v)
-			time.Sleep(time.Duration(v) * time.Second)
-
-		case "delay":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			fmt.Printf("Sleeping for %v seconds\n", v)
-			time.Sleep(time.Duration(v) * time.Second)
-
-		case "showconfig":
-			if channel == 0 {
-				err = mhs5200.ShowConfig()
-			} else {
-				err = mhs5200.ShowChannelConfig(channel)
-			}
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "showsweep":
-			err = mhs5200.ShowSweepConfig()
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "frequency":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetFrequency(channel, v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "waveform":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			err = mhs5200.SetWaveformFromString(channel, param)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "amplitude":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetAmplitude(channel, v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "duty":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetDutyCycle(channel, v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "offset":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetOffset(channel, v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "phase":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetPhase(channel, uint(v))
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "attenuation":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			if param == "on" {
-				err = mhs5200.SetAttenuation(channel, ATTENUATION_MINUS_20DB)
-			} else if param == "off" {
-				err = mhs5200.SetAttenuation(channel, ATTENUATION_0DB)
-			} else {
-				err = fmt.Errorf("Unknown parameter %v", param)
-			}
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "arbwaveform":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			err = mhs5200.SetArbitrayWaveformFromFile(slot, param)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweepstart":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetSweepStart(v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweepend":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseFloat(param, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetSweepEnd(v)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweepduration":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 64)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.SetSweepDuration(uint(v))
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweeptype":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			err = mhs5200.SetSweepType(mhs5200.SweepTypeStringToInt(param))
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweepon":
-			err = mhs5200.SetSweepState(true)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "sweepoff":
-			err = mhs5200.SetSweepState(false)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "on":
-			err = mhs5200.SetOnOff(true)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "off":
-			err = mhs5200.SetOnOff(false)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "save":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.Save(uint(v))
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "load":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			v, err := strconv.ParseUint(param, 10, 32)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-			err = mhs5200.Load(uint(v))
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
-			}
-
-		case "measure":
-			if len(param) == 0 {
-				needparam = true
-				continue
-			}
-			err = mhs5200.Measure(param)
-			if err != nil {
-				goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
-				os.Exit(10)
+	if len(*scriptfile) > 0 {
+		err := playbackScript(*scriptfile, *port)
+		if err != nil {
+			goutils.Log.Print(err)
+			if _, ok := err.(*SCRIPTFAILURE); ok {
+				os.Exit(1)
 			}
-
-		default:
-			goutils.Log.Printf("%v, %v\n", goutils.Funcname(), fmt.Errorf("Unknown command %v", cmd))
-			usage()
 			os.Exit(10)
 		}
+		if len(flag.Args()) == 0 { // nothing to do
+			return
+		}
 	}
+	if len(flag.Args()) == 0 { // nothing to do
+		usage()
+		return
+	}
+	calls, err := parseCommandLine(flag.Args())
 	if err != nil {
+		goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
 		os.Exit(10)
 	}
-	if needparam {
-		goutils.Log.Printf("Not enough parameters for %v command\n", cmd)
+	offline := true
+	for _, call := range calls {
+		if call.cmd.Name == "help" {
+			usage()
+			return
+		}
+		offline = offline && call.cmd.Offline
+	}
+	state := COMMANDSTATE{channel: 1, autoRamp: autoRamp}
+	if !offline {
+		profile, err := selectProfile("")
+		if err != nil {
+			goutils.Log.Print(err)
+			os.Exit(10)
+		}
+		mhs5200, err := openMHS5200A(*port)
+		if err != nil {
+			goutils.Log.Print(err)
+			os.Exit(10)
+		}
+		if mhs5200 == nil {
+			return
+		}
+		defer mhs5200.Close()
+		mhs5200.SetProfile(profile)
+		if !dryRun { // the progress bar would garble the printed commands
+			mhs5200.SetUploadProgress(uploadProgressBar)
+		}
+		state.mhs5200 = mhs5200
+	}
+	for _, call := range calls {
+		err = call.cmd.Run(&state, &call.data)
+		if err != nil {
+			goutils.Log.Printf("%v, %v\n", goutils.Funcname(), err)
+			safeExit(10)
+		}
 	}
 }
@@ -37,9 +37,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/peterska/go-utils"
 	"github.com/tarm/serial"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -53,6 +55,8 @@ const (
 	ATTENUATION_MINUS_20DB = 0
 	ATTENUATION_0DB        = 1
 
+	ATTENUATED_MAX_AMPLITUDE = 2.0 // volts, the largest amplitude with the -20dB attenuator on
+
 	SWEEP_LINEAR = 0
 	SWEEP_LOG    = 1
 
@@ -60,6 +64,10 @@ const (
 	SWEEP_STOP  = 1
 
 	MHS5200A_CMD_TIMEOUT = 500 * time.Millisecond
+
+	ARB_WAVEFORM_SELECT_TIMEOUT   = 5 * time.Second
+	ARB_WAVEFORM_POLL_INTERVAL    = 100 * time.Millisecond
+	ARB_WAVEFORM_PIPELINE_DEFAULT = 2
 )
 
 const (
@@ -67,6 +75,9 @@ const (
 	ARB_WAVEFORM_MAX_AMPLITUDE     = 4095
 	ARB_WAVEFORM_NUM_SLICES        = 16
 	ARB_WAVEFORM_SAMPLES_PER_SLICE = 128
+	ARB_WAVEFORM_NUM_SLOTS         = 16
+	ARB_WAVEFORM_BUILTIN_SLOT      = 15    // slot sinc and normsinc fall back on when the registry knows nothing about it
+	ARB_WAVEFORM_MAX_FREQUENCY     = 6.0e6 // bandwidth of the arbitrary waveform output
 
 	// range of input values for arbitrary waveform definition
 	ARB_WAVEFORM_INPUT_MIN  = -1.0
@@ -144,6 +155,16 @@ const (
 	COUNTER_MEASURE_DUTY_CYCLE
 )
 
+// MEASUREMENT holds the statistics of a series of counter readings
+type MEASUREMENT struct {
+	Type    string
+	Samples uint
+	Mean    float64
+	Min     float64
+	Max     float64
+	StdDev  float64
+}
+
 type SWEEPVALS struct {
 	Startf   float64
 	Endf     float64
@@ -164,14 +185,45 @@ type CHANNELVALS struct {
 	Attenuation uint    `json:"attenuation,omitempty"`
 }
 
+// ARBPROGRESSFUNC is called after each slice of an arbitrary waveform upload is acknowledged
+type ARBPROGRESSFUNC func(slot uint, slice int, slices int)
+
+// arbUploadPipelineDepth is the number of arbitrary waveform slices sent before waiting for their acknowledgements
+var arbUploadPipelineDepth = ARB_WAVEFORM_PIPELINE_DEFAULT
+
+// PORT is the connection to the instrument, a serial port or a SIMULATOR
+type PORT interface {
+	io.ReadWriteCloser
+	Flush() error
+}
+
 type MHS5200A struct {
-	stream      *serial.Port
+	stream      PORT
 	quit        chan struct{}
 	wg          sync.WaitGroup
 	mutex       sync.Mutex
 	port        string
-	measure     bool // whether we are reading measurements from the instrument
-	measuretype int  // type of measurement
+	measure     bool // whether we are reading measurements from the instrument, guarded by mutex
+	measuretype int  // type of measurement, guarded by mutex
+	serial      string
+	registry    *SLOTREGISTRY
+	pending     []byte // received bytes not yet consumed as a response
+	progress    ARBPROGRESSFUNC
+	sim         *SIMULATOR        // set in dry run mode
+	settings    map[string]string // last value set for each setting, see settingsOrder
+	safe        bool              // the safe state was applied, no further settings are sent
+	profile     *PROFILE          // limits protecting the device under test, nil for none
+}
+
+// settingsOrder lists the settings remembered by an MHS5200A in the order they are
+// restored. A loaded configuration comes first, then the waveform of each channel
+// before the values that depend on it, then the sweep and the output state last
+var settingsOrder = []string{
+	"v",
+	"1w", "1f", "1y", "1a", "1d", "1o", "1p",
+	"2w", "2f", "2y", "2a", "2d", "2o", "2p",
+	"3f", "4f", "1t", "7b", "8b",
+	"1b",
 }
 
 // normalise values to the requested range
@@ -334,6 +386,12 @@ func (mhs5200 *MHS5200A) BooleanString(v bool) string {
 }
 
 func (mhs5200 *MHS5200A) UnitsString(v float64, units string, engmode bool) string {
+	return unitsString(v, units, engmode)
+}
+
+// unitsString formats v in units, with an SI prefix in engineering mode. It needs
+// no instrument, for output that is not about one
+func unitsString(v float64, units string, engmode bool) string {
 	if engmode {
 		exponent := 0
 		for math.Abs(v) >= 1.0e3 {
@@ -356,9 +414,76 @@ func (mhs5200 *MHS5200A) UnitsString(v float64, units string, engmode bool) stri
 	}
 }
 
+// readResponse reads one newline terminated response. Bytes received after the newline belong to
+// the next response when commands are pipelined, so they are kept for the next call.
+func (mhs5200 *MHS5200A) readResponse() ([]byte, error) {
+	start := time.Now()
+	for {
+		if i := bytes.IndexByte(mhs5200.pending, '\n'); i >= 0 {
+			response := []byte(strings.TrimRight(string(mhs5200.pending[:i]), " \n\r"))
+			mhs5200.pending = append([]byte{}, mhs5200.pending[i+1:]...)
+			return response, nil
+		}
+		if time.Now().Sub(start) >= MHS5200A_CMD_TIMEOUT {
+			break
+		}
+		b, err := ioutil.ReadAll(mhs5200.stream)
+		if err != nil {
+			return nil, err
+		}
+		mhs5200.pending = append(mhs5200.pending, b...)
+	}
+	// timed out, return whatever we have
+	response := []byte(strings.TrimRight(string(mhs5200.pending), " \n\r"))
+	mhs5200.pending = nil
+	return response, nil
+}
+
+// flush discards any late responses, used to resynchronise after a failed command
+func (mhs5200 *MHS5200A) flush() {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	mhs5200.sleep(MHS5200A_CMD_TIMEOUT)
+	ioutil.ReadAll(mhs5200.stream)
+	mhs5200.stream.Flush()
+	mhs5200.pending = nil
+}
+
+// setMeasure turns the background printing of measurements on or off and returns
+// whether it was on. It stays off once the safe state has turned the counter off
+func (mhs5200 *MHS5200A) setMeasure(v bool) bool {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	was := mhs5200.measure
+	mhs5200.measure = v && !mhs5200.safe
+	return was
+}
+
+// measuring reports whether measurements are being printed in the background
+func (mhs5200 *MHS5200A) measuring() bool {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	return mhs5200.measure
+}
+
+// measurementType returns the type of measurement the counter was last switched to
+func (mhs5200 *MHS5200A) measurementType() int {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	return mhs5200.measuretype
+}
+
 func (mhs5200 *MHS5200A) sendCommand(cmd []byte) ([]byte, error) {
 	mhs5200.mutex.Lock()
 	defer mhs5200.mutex.Unlock()
+	if mhs5200.safe && bytes.HasPrefix(cmd, []byte(":s")) {
+		return nil, errSafeState
+	}
+	return mhs5200.exchange(cmd)
+}
+
+// exchange sends cmd and reads the response, the caller holds the mutex
+func (mhs5200 *MHS5200A) exchange(cmd []byte) ([]byte, error) {
 	if goutils.Loglevel() > 1 {
 		goutils.Log.Printf("%v:\tsend:\t%s\n", goutils.Callername(), string(cmd))
 	}
@@ -367,26 +492,132 @@ func (mhs5200 *MHS5200A) sendCommand(cmd []byte) ([]byte, error) {
 		goutils.Log.Print(err)
 		return nil, err
 	}
+	s, err := mhs5200.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if goutils.Loglevel() > 1 {
+		goutils.Log.Printf("%v:\treceive: %s", goutils.Callername(), s)
+	}
+	if string(s) == "ok" {
+		mhs5200.remember(string(cmd))
+	}
+	return s, nil
+}
 
-	response := []byte{}
-	start := time.Now()
-	for time.Now().Sub(start) < MHS5200A_CMD_TIMEOUT {
-		b, err := ioutil.ReadAll(mhs5200.stream)
-		if err != nil {
-			return nil, err
+// remember records the value of a setting the instrument accepted, the caller
+// holds the mutex
+func (mhs5200 *MHS5200A) remember(cmd string) {
+	if !strings.HasPrefix(cmd, ":s") || len(cmd) < 4 {
+		return
+	}
+	if cmd[2] == 'v' { // loading a saved configuration replaces everything set before
+		mhs5200.settings = map[string]string{"v": cmd[3:]}
+		return
+	}
+	if mhs5200.settings == nil {
+		mhs5200.settings = make(map[string]string)
+	}
+	key := cmd[2:4]
+	for _, k := range settingsOrder {
+		if k == key {
+			mhs5200.settings[key] = cmd[4:]
+			return
 		}
-		if len(b) > 0 {
-			response = append(response, b...)
-			if response[len(response)-1] == '\n' {
-				break
+	}
+}
+
+// Settings returns the last value set for each setting of the instrument, keyed
+// by the protocol command
+func (mhs5200 *MHS5200A) Settings() map[string]string {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	settings := make(map[string]string, len(mhs5200.settings))
+	for k, v := range mhs5200.settings {
+		settings[k] = v
+	}
+	return settings
+}
+
+// RestoreSettings sends settings returned by Settings back to the instrument, for
+// instance after it was power cycled
+func (mhs5200 *MHS5200A) RestoreSettings(settings map[string]string) error {
+	checked := false
+	for _, key := range settingsOrder {
+		v, ok := settings[key]
+		if !ok {
+			continue
+		}
+		var err error
+		if key == "1b" && !checked { // check the restored configuration before the outputs go on
+			err = mhs5200.limitSettings()
+			if err != nil {
+				return err
 			}
+			checked = true
+		}
+		if len(key) == 2 && key[1] == 'w' { // wait for arbitrary waveforms to load
+			w, perr := strconv.ParseUint(v, 10, 32)
+			if perr != nil {
+				return fmt.Errorf("Invalid waveform setting %v", v)
+			}
+			err = mhs5200.SetWaveform(uint(key[0]-'0'), uint(w))
+		} else {
+			err = mhs5200.sendCommandAndExpect([]byte(":s"+key+v), "ok")
+		}
+		if err != nil {
+			return err
 		}
 	}
-	s := []byte(strings.TrimRight(string(response), " \n\r"))
-	if goutils.Loglevel() > 1 {
-		goutils.Log.Printf("%v:\treceive: %s", goutils.Callername(), s)
+	if !checked {
+		return mhs5200.limitSettings()
 	}
-	return s, nil
+	return nil
+}
+
+// sendCommandsAndExpect sends cmds keeping up to depth of them in flight, every command must be answered with expect
+func (mhs5200 *MHS5200A) sendCommandsAndExpect(cmds [][]byte, expect string, depth int, progress func(int)) error {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	if mhs5200.safe {
+		return errSafeState
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	sent := 0
+	for acked := 0; acked < len(cmds); acked++ {
+		for sent < len(cmds) && sent-acked < depth {
+			if goutils.Loglevel() > 1 {
+				goutils.Log.Printf("%v:\tsend:\t%s\n", goutils.Callername(), string(cmds[sent]))
+			}
+			_, err := mhs5200.stream.Write(append(cmds[sent], '\n'))
+			if err != nil {
+				goutils.Log.Print(err)
+				return err
+			}
+			sent++
+		}
+		data, err := mhs5200.readResponse()
+		if err != nil {
+			return err
+		}
+		if goutils.Loglevel() > 1 {
+			goutils.Log.Printf("%v:\treceive: %s", goutils.Callername(), data)
+		}
+		if string(data) != expect {
+			return fmt.Errorf("Expected %v, got %v, %v instead for command %v", expect, string(data), data, acked)
+		}
+		if progress != nil {
+			progress(acked + 1)
+		}
+	}
+	return nil
+}
+
+// SetUploadProgress sets a function called as each arbitrary waveform slice is uploaded
+func (mhs5200 *MHS5200A) SetUploadProgress(progress ARBPROGRESSFUNC) {
+	mhs5200.progress = progress
 }
 
 func (mhs5200 *MHS5200A) sendCommandAndExpect(cmd []byte, expect string) error {
@@ -445,7 +676,8 @@ func (mhs5200 *MHS5200A) GetDutyCycleMeasurement() (float64, error) {
 }
 
 func (mhs5200 *MHS5200A) GetMeasurement() (float64, error) {
-	switch mhs5200.measuretype {
+	measuretype := mhs5200.measurementType()
+	switch measuretype {
 	case COUNTER_MEASURE_FREQUENCY:
 		return mhs5200.GetFrequencyMeasurement()
 
@@ -465,7 +697,7 @@ func (mhs5200 *MHS5200A) GetMeasurement() (float64, error) {
 	case COUNTER_MEASURE_DUTY_CYCLE:
 		return mhs5200.GetDutyCycleMeasurement()
 	}
-	return math.NaN(), fmt.Errorf("Unknown measurement type %v", mhs5200.measuretype)
+	return math.NaN(), fmt.Errorf("Unknown measurement type %v", measuretype)
 }
 
 func (mhs5200 *MHS5200A) GetMeasurementAsString() (string, error) {
@@ -473,69 +705,105 @@ func (mhs5200 *MHS5200A) GetMeasurementAsString() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	switch mhs5200.measuretype {
-	case COUNTER_MEASURE_FREQUENCY:
-		return mhs5200.FrequencyString(v), nil
-
-	case COUNTER_MEASURE_COUNT:
-		return fmt.Sprintf("%v", uint(v)), nil
-
-	case COUNTER_MEASURE_PERIOD:
-		return mhs5200.UnitsString(v, "s", true), nil
-
-	case COUNTER_MEASURE_PULSE_WIDTH:
-		return mhs5200.UnitsString(v, "s", true), nil
-
-	case COUNTER_MEASURE_NEGATIVE_PULSE_WIDTH:
-		return mhs5200.UnitsString(v, "s", true), nil
-
-	case COUNTER_MEASURE_DUTY_CYCLE:
-		return mhs5200.DutyCycleString(v), nil
-	}
-	return "", fmt.Errorf("Unknown measurement type %v", mhs5200.measuretype)
+	return mhs5200.MeasurementString(v), nil
 }
 
-func (mhs5200 *MHS5200A) Measure(cmd string) error {
-	var err error = nil
+// selectMeasurement switches the counter to the measurement type named by cmd
+func (mhs5200 *MHS5200A) selectMeasurement(cmd string) error {
+	var measuretype int
 	switch cmd {
-	case "stop":
-		mhs5200.measure = false
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s6b%d", 0)), "ok")
-
 	case "frequency":
-		mhs5200.measuretype = COUNTER_MEASURE_FREQUENCY
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_FREQUENCY
 
 	case "count":
-		mhs5200.measuretype = COUNTER_MEASURE_COUNT
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_COUNT
 
 	case "period":
-		mhs5200.measuretype = COUNTER_MEASURE_PERIOD
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_PERIOD
 
 	case "pulsewidth":
-		mhs5200.measuretype = COUNTER_MEASURE_PULSE_WIDTH
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_PULSE_WIDTH
 
 	case "negativepulsewidth":
-		mhs5200.measuretype = COUNTER_MEASURE_NEGATIVE_PULSE_WIDTH
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_NEGATIVE_PULSE_WIDTH
 
 	case "duty":
-		mhs5200.measuretype = COUNTER_MEASURE_DUTY_CYCLE
-		err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", mhs5200.measuretype)), "ok")
-		mhs5200.measure = true
+		measuretype = COUNTER_MEASURE_DUTY_CYCLE
 
 	default:
-		err = fmt.Errorf("unknown measure paramter %v", cmd)
+		return fmt.Errorf("unknown measure paramter %v", cmd)
+	}
+	mhs5200.mutex.Lock()
+	mhs5200.measuretype = measuretype
+	mhs5200.mutex.Unlock()
+	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dm", measuretype)), "ok")
+}
+
+func (mhs5200 *MHS5200A) Measure(cmd string) error {
+	if cmd == "stop" || cmd == "off" { // off is used by older scripts
+		mhs5200.setMeasure(false)
+		return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s6b%d", 0)), "ok")
+	}
+	err := mhs5200.selectMeasurement(cmd)
+	if err != nil {
+		return err
+	}
+	mhs5200.setMeasure(true)
+	return nil
+}
+
+// MeasureAverage switches the counter to the measurement type named by cmd, waits
+// one interval for the counter to settle and then takes samples readings interval
+// apart. The background printing of measurements is paused while sampling
+func (mhs5200 *MHS5200A) MeasureAverage(cmd string, samples uint, interval time.Duration) (*MEASUREMENT, error) {
+	if samples == 0 {
+		samples = 1
+	}
+	printing := mhs5200.setMeasure(false)
+	defer mhs5200.setMeasure(printing)
+	err := mhs5200.selectMeasurement(cmd)
+	if err != nil {
+		return nil, err
+	}
+	m := MEASUREMENT{
+		Type: cmd,
+		Min:  math.Inf(1),
+		Max:  math.Inf(-1),
+	}
+	sum, sumsq := 0.0, 0.0
+	for n := uint(0); n < samples; n++ {
+		mhs5200.sleep(interval)
+		v, err := mhs5200.GetMeasurement()
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+		sumsq += v * v
+		m.Min = math.Min(m.Min, v)
+		m.Max = math.Max(m.Max, v)
+		m.Samples++
+	}
+	m.Mean = sum / float64(m.Samples)
+	m.StdDev = math.Sqrt(math.Max(0, sumsq/float64(m.Samples)-m.Mean*m.Mean))
+	if goutils.Loglevel() > 0 {
+		goutils.Log.Printf("%v: %+v", goutils.Funcname(), m)
 	}
-	return err
+	return &m, nil
+}
+
+// MeasurementString formats a value of the counter's current measurement type
+func (mhs5200 *MHS5200A) MeasurementString(v float64) string {
+	switch mhs5200.measurementType() {
+	case COUNTER_MEASURE_FREQUENCY:
+		return mhs5200.FrequencyString(v)
+
+	case COUNTER_MEASURE_COUNT:
+		return fmt.Sprintf("%v", uint(v))
+
+	case COUNTER_MEASURE_DUTY_CYCLE:
+		return mhs5200.DutyCycleString(v)
+	}
+	return mhs5200.UnitsString(v, "s", true)
 }
 
 func (mhs5200 *MHS5200A) FrequencyString(v float64) string {
@@ -549,6 +817,10 @@ func (mhs5200 *MHS5200A) SetFrequency(ch uint, v float64) error {
 	if v < 0.0 || v > 25.0e6 {
 		return fmt.Errorf("%v is not a valid frequency", v)
 	}
+	v, err := mhs5200.limitFrequency(ch, v)
+	if err != nil {
+		return err
+	}
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%df%d", ch, int(v*100.0))), "ok")
 }
 
@@ -593,6 +865,12 @@ func (mhs5200 *MHS5200A) WaveformString(v uint) string {
 }
 
 func (mhs5200 *MHS5200A) WaveformStringToInt(s string) uint {
+	return waveformStringToInt(s)
+}
+
+// waveformStringToInt converts a waveform name to its number, math.MaxUint32 for
+// unknown names. It needs no instrument, so scripts can be checked without one
+func waveformStringToInt(s string) uint {
 	switch s {
 	case WAVEFORM_SINE_STR:
 		return WAVEFORM_SINE
@@ -635,8 +913,8 @@ func (mhs5200 *MHS5200A) WaveformStringToInt(s string) uint {
 	}
 }
 
-// NormalisedToArbitraryWaveform convert an amplitude in the range -1.0 - 1.0 to a value in the range of the arbitrary waveform
-func (mhs5200 *MHS5200A) NormalisedToArbitraryWaveform(v float64) int {
+// normalisedToArbitraryWaveform convert an amplitude in the range -1.0 - 1.0 to a value in the range of the arbitrary waveform
+func normalisedToArbitraryWaveform(v float64) int {
 	if v > 1.0 {
 		goutils.Log.Printf("adjusting bad value %v", v)
 		v = 1.0
@@ -648,6 +926,30 @@ func (mhs5200 *MHS5200A) NormalisedToArbitraryWaveform(v float64) int {
 	return int(math.Round(v))
 }
 
+// arbitraryWaveformToNormalised convert an arbitrary waveform sample back to an amplitude in the range -1.0 - 1.0
+func arbitraryWaveformToNormalised(v int) float64 {
+	return ARB_WAVEFORM_INPUT_MIN + (float64(v)-ARB_WAVEFORM_OUTPUT_MIN)*(ARB_WAVEFORM_INPUT_MAX-ARB_WAVEFORM_INPUT_MIN)/(ARB_WAVEFORM_OUTPUT_MAX-ARB_WAVEFORM_OUTPUT_MIN)
+}
+
+// quantiseArbitraryWaveform converts normalised samples to the 12 bit values the generator stores
+func quantiseArbitraryWaveform(data []float64) []int {
+	samples := make([]int, len(data))
+	for i, v := range data {
+		samples[i] = normalisedToArbitraryWaveform(v)
+	}
+	return samples
+}
+
+// NormalisedToArbitraryWaveform convert an amplitude in the range -1.0 - 1.0 to a value in the range of the arbitrary waveform
+func (mhs5200 *MHS5200A) NormalisedToArbitraryWaveform(v float64) int {
+	return normalisedToArbitraryWaveform(v)
+}
+
+// ArbitraryWaveformToNormalised convert an arbitrary waveform sample back to an amplitude in the range -1.0 - 1.0
+func (mhs5200 *MHS5200A) ArbitraryWaveformToNormalised(v int) float64 {
+	return arbitraryWaveformToNormalised(v)
+}
+
 /* Aribtrary waveform format:
 *
 * Waveform Length 2048 point
@@ -660,63 +962,96 @@ func (mhs5200 *MHS5200A) NormalisedToArbitraryWaveform(v float64) int {
 
 // SetArbitrayWaveform send an arbitrary waveform to the generator
 func (mhs5200 *MHS5200A) SetArbitraryWaveform(slot uint, data []float64) error {
+	return mhs5200.setArbitraryWaveform(slot, data, "")
+}
+
+func (mhs5200 *MHS5200A) setArbitraryWaveform(slot uint, data []float64, source string) error {
 	if len(data) != ARB_WAVEFORM_NUM_POINTS {
 		return fmt.Errorf("An abrbitrary waveform must contain exactly %v samples", ARB_WAVEFORM_NUM_POINTS)
 	}
+	if slot >= ARB_WAVEFORM_NUM_SLOTS {
+		return fmt.Errorf("%v is not a valid arbitrary waveform slot", slot)
+	}
+	samples := quantiseArbitraryWaveform(data)
+	cmds := make([][]byte, ARB_WAVEFORM_NUM_SLICES)
 	for slice := 0; slice < ARB_WAVEFORM_NUM_SLICES; slice++ {
 		cmd := fmt.Sprintf(":a%x%x", slot, slice)
 		for sample := 0; sample < ARB_WAVEFORM_SAMPLES_PER_SLICE; sample++ {
-			cmd += fmt.Sprintf("%d", mhs5200.NormalisedToArbitraryWaveform(data[slice*ARB_WAVEFORM_SAMPLES_PER_SLICE+sample]))
+			cmd += fmt.Sprintf("%d", samples[slice*ARB_WAVEFORM_SAMPLES_PER_SLICE+sample])
 			if sample != (ARB_WAVEFORM_SAMPLES_PER_SLICE - 1) {
 				cmd += ","
 			}
 		}
-		err := mhs5200.sendCommandAndExpect([]byte(cmd), "ok")
-		if err != nil {
-			goutils.Log.Printf("%v failed to send arbitrary waveform slice %v", goutils.Funcname(), slice)
-			return err
+		cmds[slice] = []byte(cmd)
+	}
+	progress := func(slices int) {
+		if mhs5200.progress != nil {
+			mhs5200.progress(slot, slices, ARB_WAVEFORM_NUM_SLICES)
 		}
 	}
+	start := time.Now()
+	err := mhs5200.sendCommandsAndExpect(cmds, "ok", arbUploadPipelineDepth, progress)
+	if err != nil && arbUploadPipelineDepth > 1 {
+		goutils.Log.Printf("%v pipelined upload of slot %v failed, %v, retrying one slice at a time", goutils.Funcname(), slot, err)
+		mhs5200.flush()
+		err = mhs5200.sendCommandsAndExpect(cmds, "ok", 1, progress)
+	}
+	if err != nil {
+		goutils.Log.Printf("%v failed to send arbitrary waveform to slot %v", goutils.Funcname(), slot)
+		return err
+	}
+	if goutils.Loglevel() > 0 {
+		goutils.Log.Printf("%v uploaded slot %v in %v", goutils.Funcname(), slot, time.Since(start))
+	}
+	err = mhs5200.recordArbitraryWaveform(slot, source, samples)
+	if err != nil { // the upload itself succeeded, so just warn
+		goutils.Log.Printf("%v failed to record slot %v in the slot registry, %v", goutils.Funcname(), slot, err)
+	}
 	return nil
 }
 
-func (mhs5200 *MHS5200A) SetArbitrayWaveformFromFile(slot uint, filename string) error {
+// loadArbitraryWaveformFile reads a 2048 sample arbitrary waveform, 1 sample per line in the -1.0 to 1.0 range
+func loadArbitraryWaveformFile(filename string) ([]float64, error) {
 	if len(filename) == 0 {
-		return fmt.Errorf("filename is empty")
+		return nil, fmt.Errorf("filename is empty")
 	}
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 	data := make([]float64, ARB_WAVEFORM_NUM_POINTS)
 	sample := 0
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		s := scanner.Text()
-		if s[0] == '#' { // comment
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || s[0] == '#' { // blank line or comment
 			continue
 		}
 		v, err := strconv.ParseFloat(s, 64)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if v > 1.0 || v < -1.0 {
-			return fmt.Errorf("Arbitrary waveform sample values must be between -1.0 and 1.0")
+			return nil, fmt.Errorf("Arbitrary waveform sample values must be between -1.0 and 1.0")
+		}
+		if sample >= ARB_WAVEFORM_NUM_POINTS {
+			return nil, fmt.Errorf("An abrbitrary waveform must contain exactly %v samples, %v has more", ARB_WAVEFORM_NUM_POINTS, filename)
 		}
 		data[sample] = v
 		sample++
 	}
 	if err := scanner.Err(); err != nil {
-		return err
+		return nil, err
 	}
 	if sample != ARB_WAVEFORM_NUM_POINTS {
-		return fmt.Errorf("An abrbitrary waveform must contain exactly %v samples, only read %v samples", ARB_WAVEFORM_NUM_POINTS, sample)
-	}
-	err = mhs5200.SetArbitraryWaveform(slot, data)
-	if err != nil {
-		return err
+		return nil, fmt.Errorf("An abrbitrary waveform must contain exactly %v samples, only read %v samples", ARB_WAVEFORM_NUM_POINTS, sample)
 	}
-	return mhs5200.SetWaveform(1, WAVEFORM_ARB_0+slot)
+	return data, nil
+}
+
+func (mhs5200 *MHS5200A) SetArbitrayWaveformFromFile(slot uint, filename string) error {
+	return mhs5200.SetTransformedArbitraryWaveformFromFile(1, slot, filename, nil)
 }
 
 func (mhs5200 *MHS5200A) IsArbirtraryWaveform(v uint) bool {
@@ -731,40 +1066,58 @@ func (mhs5200 *MHS5200A) IsArbirtraryWaveform(v uint) bool {
 func (mhs5200 *MHS5200A) SetWaveform(ch uint, v uint) error {
 	switch v { // handle our custom waveforms
 	case WAVEFORM_SINC:
-		data := generateSinc()
-		err := mhs5200.SetArbitraryWaveform(WAVEFORM_ARB_15-WAVEFORM_ARB_0, data)
-		if err != nil {
-			return err
-		}
-		return mhs5200.SetWaveform(ch, WAVEFORM_ARB_15)
+		return mhs5200.setNamedArbitraryWaveform(ch, WAVEFORM_SINC_STR, generateSinc(), WAVEFORM_SINC_STR)
 
 	case WAVEFORM_NORM_SINC:
-		data := generateNormalisedSinc()
-		err := mhs5200.SetArbitraryWaveform(WAVEFORM_ARB_15-WAVEFORM_ARB_0, data)
-		if err != nil {
-			return err
-		}
-		return mhs5200.SetWaveform(ch, WAVEFORM_ARB_15)
+		return mhs5200.setNamedArbitraryWaveform(ch, WAVEFORM_NORM_SINC_STR, generateNormalisedSinc(), WAVEFORM_NORM_SINC_STR)
 	}
 	if (v > WAVEFORM_DESCENDING_SAWTOOTH && v < WAVEFORM_ARB_0) || v > WAVEFORM_ARB_15 {
 		return fmt.Errorf("%v is not a valid waveform", v)
 	}
-	err := mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dw%d", ch, v)), "ok")
+	err := mhs5200.limitWaveform(ch, mhs5200.WaveformString(v))
+	if err != nil {
+		return err
+	}
+	err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dw%d", ch, v)), "ok")
 	if err != nil {
 		return err
 	}
 	if mhs5200.IsArbirtraryWaveform(v) {
-		// We need to delay before sending the next command
-		time.Sleep(2 * time.Second)
+		// The generator does not respond while it loads an arbitrary waveform, wait until it does
+		return mhs5200.waitArbitraryWaveformReady(ch, v)
 	}
 	return nil
 }
 
+// waitArbitraryWaveformReady polls the generator until it reports arbitrary waveform v selected on channel ch
+func (mhs5200 *MHS5200A) waitArbitraryWaveformReady(ch uint, v uint) error {
+	start := mhs5200.now()
+	for mhs5200.now().Sub(start) < ARB_WAVEFORM_SELECT_TIMEOUT {
+		mhs5200.sleep(ARB_WAVEFORM_POLL_INTERVAL)
+		w, err := mhs5200.GetWaveform(ch)
+		if err != nil { // a late answer would be taken as the response to the next command
+			mhs5200.flush()
+			continue
+		}
+		if mhs5200.WaveformString(w) == mhs5200.WaveformString(v) {
+			if goutils.Loglevel() > 0 {
+				goutils.Log.Printf("%v %v ready after %v", goutils.Funcname(), mhs5200.WaveformString(v), mhs5200.now().Sub(start))
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Timed out waiting for %v to be selected on channel %v", mhs5200.WaveformString(v), ch)
+}
+
 func (mhs5200 *MHS5200A) SetWaveformFromString(ch uint, s string) error {
 	if len(s) == 0 {
 		return nil
 	}
-	return mhs5200.SetWaveform(ch, mhs5200.WaveformStringToInt(s))
+	v := mhs5200.WaveformStringToInt(s)
+	if v == math.MaxUint32 && isLibraryWaveform(s) {
+		return mhs5200.SetLibraryWaveform(ch, s)
+	}
+	return mhs5200.SetWaveform(ch, v)
 }
 
 func (mhs5200 *MHS5200A) GetWaveform(ch uint) (uint, error) {
@@ -791,6 +1144,10 @@ func (mhs5200 *MHS5200A) SetAmplitude(ch uint, v float64) error {
 	if math.IsNaN(v) {
 		return nil
 	}
+	v, err := mhs5200.limitAmplitude(ch, v)
+	if err != nil {
+		return err
+	}
 	attenuation, err := mhs5200.GetAttenuation(ch)
 	if err != nil {
 		return err
@@ -876,6 +1233,10 @@ func (mhs5200 *MHS5200A) SetOffset(ch uint, v float64) error {
 	if err != nil {
 		return err
 	}
+	v, err = mhs5200.limitOffset(ch, v, ampl)
+	if err != nil {
+		return err
+	}
 	v = v / ampl * 100.0
 	if v < -120 || v > 120 {
 		return fmt.Errorf("%v is not a valid offset. Supported values are between -120%% and 120%% of the amplitude value", v)
@@ -945,6 +1306,12 @@ func (mhs5200 *MHS5200A) SetAttenuation(ch uint, v uint) error {
 	if v == math.MaxUint32 {
 		return nil
 	}
+	if v == ATTENUATION_0DB {
+		err := mhs5200.limitAttenuationOff(ch)
+		if err != nil {
+			return err
+		}
+	}
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s%dy%d", ch, v)), "ok")
 }
 
@@ -993,6 +1360,12 @@ func (mhs5200 *MHS5200A) SweepTypeString(v uint) string {
 }
 
 func (mhs5200 *MHS5200A) SweepTypeStringToInt(s string) uint {
+	return sweepTypeStringToInt(s)
+}
+
+// sweepTypeStringToInt converts a sweep type name to its number, math.MaxUint32 for
+// unknown names
+func sweepTypeStringToInt(s string) uint {
 	switch s {
 	case "linear":
 		return SWEEP_LINEAR
@@ -1014,6 +1387,10 @@ func (mhs5200 *MHS5200A) SetSweepStart(v float64) error {
 	if v < 0.0 || v > 25.0e6 {
 		return fmt.Errorf("%v is not a valid frequency", v)
 	}
+	v, err := mhs5200.limitFrequency(1, v) // the sweep runs on channel 1
+	if err != nil {
+		return err
+	}
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s3f%d", int(v*100.0))), "ok")
 }
 
@@ -1032,6 +1409,10 @@ func (mhs5200 *MHS5200A) SetSweepEnd(v float64) error {
 	if v < 0.0 || v > 25.0e6 {
 		return fmt.Errorf("%v is not a valid frequency", v)
 	}
+	v, err := mhs5200.limitFrequency(1, v) // the sweep runs on channel 1
+	if err != nil {
+		return err
+	}
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s4f%d", int(v*100.0))), "ok")
 }
 
@@ -1152,6 +1533,14 @@ func (mhs5200 *MHS5200A) SetOnOff(v bool) error {
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":s1b%d", state)), "ok")
 }
 
+func (mhs5200 *MHS5200A) GetOnOff() (bool, error) {
+	v, err := mhs5200.sendCommandAndExpectUint([]byte(":r1b"))
+	if err != nil {
+		return false, err
+	}
+	return v == 1, nil
+}
+
 func (mhs5200 *MHS5200A) SelectChannel(ch uint) error {
 	if ch == 0 {
 		return nil
@@ -1169,11 +1558,37 @@ func (mhs5200 *MHS5200A) Save(v uint) error {
 	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":su%02d", v)), "ok")
 }
 
+// Load loads a saved configuration. With a limit profile the outputs are kept off
+// until the loaded configuration has been checked against it, and are only turned
+// back on if it passes
 func (mhs5200 *MHS5200A) Load(v uint) error {
 	if v > 15 {
 		return fmt.Errorf("%v is not a valid load position", v)
 	}
-	return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":sv%02d", v)), "ok")
+	if mhs5200.profile == nil {
+		return mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":sv%02d", v)), "ok")
+	}
+	on, err := mhs5200.GetOnOff()
+	if err != nil {
+		return err
+	}
+	err = mhs5200.SetOnOff(false)
+	if err != nil {
+		return err
+	}
+	err = mhs5200.sendCommandAndExpect([]byte(fmt.Sprintf(":sv%02d", v)), "ok")
+	if err != nil {
+		return err
+	}
+	err = mhs5200.SetOnOff(false)
+	if err != nil {
+		return err
+	}
+	err = mhs5200.limitSettings()
+	if err != nil {
+		return fmt.Errorf("configuration %v: %v", v, err)
+	}
+	return mhs5200.SetOnOff(on)
 }
 
 func (mhs5200 *MHS5200A) GetModel() (string, error) {
@@ -1320,13 +1735,26 @@ func (mhs5200 *MHS5200A) ApplyChannelConfig(v *CHANNELVALS) error {
 	if v == nil {
 		return fmt.Errorf("null data")
 	}
-	var err error
+	limited := *v
+	v = &limited
+	err := mhs5200.limitChannelConfig(v)
+	if err != nil {
+		return err
+	}
 	if v.Channel != math.MaxUint32 {
 		err = mhs5200.SelectChannel(v.Channel)
 		if err != nil {
 			return err
 		}
 	}
+	if v.Attenuation == ATTENUATION_0DB && !math.IsNaN(v.Amplitude) && mhs5200.profile != nil {
+		// the attenuator scales the amplitude tenfold, lower it first so turning the
+		// attenuator off does not overshoot the new amplitude
+		err = mhs5200.SetAmplitude(v.Channel, math.Max(v.Amplitude/10.0, 5e-3))
+		if err != nil {
+			return err
+		}
+	}
 	if v.Attenuation != math.MaxUint32 {
 		err = mhs5200.SetAttenuation(v.Channel, v.Attenuation)
 		if err != nil {
@@ -1346,6 +1774,14 @@ func (mhs5200 *MHS5200A) ApplyChannelConfig(v *CHANNELVALS) error {
 		}
 	}
 	if !math.IsNaN(v.Amplitude) {
+		if mhs5200.profile != nil && !math.IsNaN(v.Offset) {
+			// the offset scales with the amplitude, remove it so the new amplitude is
+			// checked and output without the old offset pushing it past the envelope
+			err = mhs5200.SetOffset(v.Channel, 0.0)
+			if err != nil {
+				return err
+			}
+		}
 		err = mhs5200.SetAmplitude(v.Channel, v.Amplitude)
 		if err != nil {
 			return err
@@ -1382,7 +1818,7 @@ func (mhs5200 *MHS5200A) mhs5200() {
 			return
 
 		case <-measure_ticker.C:
-			if mhs5200.measure {
+			if mhs5200.measuring() {
 				s, err := mhs5200.GetMeasurementAsString()
 				if err == nil {
 					fmt.Println(s)
@@ -1422,6 +1858,7 @@ func NewMHS5200A(port string) (*MHS5200A, error) {
 }
 
 func (mhs5200 *MHS5200A) Close() {
+	forgetDevice(mhs5200)
 	close(mhs5200.quit)
 	mhs5200.wg.Wait()
 	if mhs5200.stream != nil {
@@ -1429,25 +1866,27 @@ func (mhs5200 *MHS5200A) Close() {
 	}
 }
 
-func convertWaveFile(filename string) error {
+// normaliseWaveFile reads raw samples from filename, normalises them to the -1.0 to 1.0 range and converts old style 1024 point files
+func normaliseWaveFile(filename string) ([]float64, error) {
 	if len(filename) == 0 {
-		return fmt.Errorf("filename is empty")
+		return nil, fmt.Errorf("filename is empty")
 	}
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 	data := make([]float64, 0)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		v, err := strconv.ParseFloat(scanner.Text(), 64)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		data = append(data, v)
 	}
 	if err := scanner.Err(); err != nil {
-		return err
+		return nil, err
 	}
 	autoNormalise(data, -1.0, 1.0)
 	if len(data) == 1024 { // old style 1024 point file convert it
@@ -1463,6 +1902,14 @@ func convertWaveFile(filename string) error {
 		}
 		data = waveform
 	}
+	return data, nil
+}
+
+func convertWaveFile(filename string) error {
+	data, err := normaliseWaveFile(filename)
+	if err != nil {
+		return err
+	}
 	for i, _ := range data {
 		fmt.Println(data[i])
 	}
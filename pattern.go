@@ -0,0 +1,394 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/* Digital patterns
+*
+* A pattern is rendered as a sequence of logic level segments whose lengths are in bit periods.
+* One cycle of the arbitrary waveform holds the whole sequence, so the generator frequency needed
+* for a bit rate is the bit rate divided by the length of the sequence. Logic 0 is rendered as -1.0
+* and logic 1 as 1.0, the actual levels are set with amplitude and offset.
+*
+ */
+
+const (
+	PATTERN_NRZ        = "nrz"
+	PATTERN_MANCHESTER = "manchester"
+	PATTERN_UART       = "uart"
+	PATTERN_I2C        = "i2c"
+	PATTERN_PRBS7      = "prbs7"
+	PATTERN_PRBS15     = "prbs15"
+	PATTERN_PULSE      = "pulse"
+
+	PATTERN_MIN_SAMPLES_PER_BIT = 2
+)
+
+type PATTERN struct {
+	Encoding string  `json:"encoding"`
+	Data     string  `json:"data,omitempty"`    // bits for nrz and manchester, text or 0x prefixed hex bytes for uart and i2c
+	Bitrate  float64 `json:"bitrate,omitempty"` // target bit rate, used to calculate the generator frequency
+	Bits     uint    `json:"bits,omitempty"`    // uart data bits, default 8
+	Parity   string  `json:"parity,omitempty"`  // uart parity, none, even or odd
+	Stop     uint    `json:"stop,omitempty"`    // uart stop bits, default 1
+	Idle     float64 `json:"idle,omitempty"`    // idle bit periods appended to the pattern
+	Rise     float64 `json:"rise,omitempty"`    // edge rise time as a fraction of a bit period
+	Count    uint    `json:"count,omitempty"`   // number of prbs bits or pulses
+	Duty     float64 `json:"duty,omitempty"`    // pulse duty cycle in %
+	Clock    bool    `json:"clock,omitempty"`   // render the i2c SCL line instead of SDA
+	Invert   bool    `json:"invert,omitempty"`
+}
+
+type patternSegment struct {
+	level  bool
+	length float64 // bit periods
+}
+
+type patternBuilder struct {
+	segments []patternSegment
+	length   float64
+}
+
+func (b *patternBuilder) add(level bool, length float64) {
+	if length <= 0.0 {
+		return
+	}
+	n := len(b.segments)
+	if n > 0 && b.segments[n-1].level == level {
+		b.segments[n-1].length += length
+	} else {
+		b.segments = append(b.segments, patternSegment{level: level, length: length})
+	}
+	b.length += length
+}
+
+func parsePatternBits(s string) ([]bool, error) {
+	bits := make([]bool, 0)
+	for _, c := range s {
+		switch c {
+		case '0':
+			bits = append(bits, false)
+
+		case '1':
+			bits = append(bits, true)
+
+		case ' ', '_', ',':
+
+		default:
+			return nil, fmt.Errorf("%q is not a valid bit", c)
+		}
+	}
+	if len(bits) == 0 {
+		return nil, fmt.Errorf("no bits specified")
+	}
+	return bits, nil
+}
+
+// parsePatternBytes accepts 0x prefixed hex bytes separated by spaces or commas, anything else is used as text
+func parsePatternBytes(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") {
+		if len(s) == 0 {
+			return nil, fmt.Errorf("no data specified")
+		}
+		return []byte(s), nil
+	}
+	data := make([]byte, 0)
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		v, err := strconv.ParseUint(strings.TrimPrefix(field, "0x"), 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, byte(v))
+	}
+	return data, nil
+}
+
+// prbs returns count bits of the maximal length sequence generated by x^order + x^tap + 1
+func prbs(order uint, tap uint, count uint) []bool {
+	bits := make([]bool, count)
+	state := uint32(1<<order) - 1
+	for i := range bits {
+		feedback := ((state >> (order - 1)) ^ (state >> (tap - 1))) & 1
+		state = ((state << 1) | feedback) & (1<<order - 1)
+		bits[i] = feedback == 1
+	}
+	return bits
+}
+
+func (pattern *PATTERN) segments() (*patternBuilder, error) {
+	b := patternBuilder{}
+	switch pattern.Encoding {
+	case PATTERN_NRZ:
+		bits, err := parsePatternBits(pattern.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, bit := range bits {
+			b.add(bit, 1.0)
+		}
+		b.add(false, pattern.Idle)
+
+	case PATTERN_MANCHESTER:
+		// IEEE 802.3 convention, 0 is a high to low transition and 1 a low to high transition
+		bits, err := parsePatternBits(pattern.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, bit := range bits {
+			b.add(!bit, 0.5)
+			b.add(bit, 0.5)
+		}
+		b.add(false, pattern.Idle)
+
+	case PATTERN_UART:
+		data, err := parsePatternBytes(pattern.Data)
+		if err != nil {
+			return nil, err
+		}
+		nbits := pattern.Bits
+		if nbits == 0 {
+			nbits = 8
+		}
+		if nbits < 5 || nbits > 9 {
+			return nil, fmt.Errorf("%v is not a valid number of uart data bits", nbits)
+		}
+		stop := pattern.Stop
+		if stop == 0 {
+			stop = 1
+		}
+		for _, c := range data {
+			b.add(false, 1.0) // start bit
+			ones := 0
+			for i := uint(0); i < nbits; i++ { // lsb first
+				bit := (uint(c)>>i)&1 == 1
+				if bit {
+					ones++
+				}
+				b.add(bit, 1.0)
+			}
+			switch pattern.Parity {
+			case "", "none":
+
+			case "even":
+				b.add(ones%2 == 1, 1.0)
+
+			case "odd":
+				b.add(ones%2 == 0, 1.0)
+
+			default:
+				return nil, fmt.Errorf("%v is not a valid parity, use none, even or odd", pattern.Parity)
+			}
+			b.add(true, float64(stop))
+		}
+		b.add(true, pattern.Idle)
+
+	case PATTERN_I2C:
+		// every bit is a low and a high half of SCL, SDA only changes while SCL is low
+		data, err := parsePatternBytes(pattern.Data)
+		if err != nil {
+			return nil, err
+		}
+		half := func(sda bool, scl bool) {
+			if pattern.Clock {
+				b.add(scl, 0.5)
+			} else {
+				b.add(sda, 0.5)
+			}
+		}
+		half(true, true)
+		half(false, true) // start condition
+		for _, c := range data {
+			for i := 7; i >= 0; i-- { // msb first
+				bit := (c>>uint(i))&1 == 1
+				half(bit, false)
+				half(bit, true)
+			}
+			half(false, false) // ack from the receiver
+			half(false, true)
+		}
+		half(false, false)
+		half(false, true)
+		half(true, true) // stop condition
+		b.add(true, pattern.Idle)
+
+	case PATTERN_PRBS7, PATTERN_PRBS15:
+		order, tap, count := uint(7), uint(6), uint(127)
+		if pattern.Encoding == PATTERN_PRBS15 {
+			order, tap, count = 15, 14, ARB_WAVEFORM_NUM_POINTS/PATTERN_MIN_SAMPLES_PER_BIT
+		}
+		if pattern.Count > 0 {
+			count = pattern.Count
+		}
+		for _, bit := range prbs(order, tap, count) {
+			b.add(bit, 1.0)
+		}
+		b.add(false, pattern.Idle)
+
+	case PATTERN_PULSE:
+		count := pattern.Count
+		if count == 0 {
+			count = 1
+		}
+		duty := pattern.Duty
+		if duty == 0.0 {
+			duty = 50.0
+		}
+		if duty <= 0.0 || duty >= 100.0 {
+			return nil, fmt.Errorf("%v is not a valid duty cycle", duty)
+		}
+		for i := uint(0); i < count; i++ {
+			b.add(true, duty/100.0)
+			b.add(false, 1.0-duty/100.0)
+		}
+		b.add(false, pattern.Idle)
+
+	default:
+		return nil, fmt.Errorf("%v is not a valid pattern encoding. Valid encodings are nrz, manchester, uart, i2c, prbs7, prbs15, pulse", pattern.Encoding)
+	}
+	if b.length*PATTERN_MIN_SAMPLES_PER_BIT > ARB_WAVEFORM_NUM_POINTS {
+		return nil, fmt.Errorf("pattern is %v bit periods long, at most %v fit in an arbitrary waveform", b.length, ARB_WAVEFORM_NUM_POINTS/PATTERN_MIN_SAMPLES_PER_BIT)
+	}
+	return &b, nil
+}
+
+// Render converts the pattern to a 2048 sample arbitrary waveform and returns it along with its length in bit periods
+func (pattern *PATTERN) Render() ([]float64, float64, error) {
+	b, err := pattern.segments()
+	if err != nil {
+		return nil, 0.0, err
+	}
+	if pattern.Rise < 0.0 || pattern.Rise > 1.0 {
+		return nil, 0.0, fmt.Errorf("%v is not a valid rise time, use a fraction of a bit period between 0 and 1", pattern.Rise)
+	}
+	ideal := make([]float64, ARB_WAVEFORM_NUM_POINTS)
+	segment, end := 0, b.segments[0].length
+	for i := range ideal {
+		t := (float64(i) + 0.5) * b.length / ARB_WAVEFORM_NUM_POINTS
+		for t > end && segment < len(b.segments)-1 {
+			segment++
+			end += b.segments[segment].length
+		}
+		if b.segments[segment].level != pattern.Invert {
+			ideal[i] = 1.0
+		} else {
+			ideal[i] = -1.0
+		}
+	}
+	// a circular moving average turns every edge into a linear ramp lasting the rise time
+	width := int(math.Round(pattern.Rise * ARB_WAVEFORM_NUM_POINTS / b.length))
+	if width <= 1 {
+		return ideal, b.length, nil
+	}
+	data := make([]float64, ARB_WAVEFORM_NUM_POINTS)
+	for i := range data {
+		sum := 0.0
+		for j := 0; j < width; j++ {
+			sum += ideal[(i-width/2+j+ARB_WAVEFORM_NUM_POINTS)%ARB_WAVEFORM_NUM_POINTS]
+		}
+		data[i] = sum / float64(width)
+	}
+	return data, b.length, nil
+}
+
+func (pattern *PATTERN) String() string {
+	s := pattern.Encoding
+	if len(pattern.Data) > 0 {
+		s += " " + pattern.Data
+	}
+	if pattern.Bitrate > 0.0 {
+		s += fmt.Sprintf(" at %g bit/s", pattern.Bitrate)
+	}
+	return s
+}
+
+// parsePattern parses a JSON pattern description, either given directly or read from a file
+func parsePattern(spec string) (*PATTERN, error) {
+	jsn := []byte(spec)
+	if !strings.HasPrefix(strings.TrimSpace(spec), "{") {
+		var err error
+		jsn, err = ioutil.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pattern := PATTERN{}
+	err := json.Unmarshal(jsn, &pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &pattern, nil
+}
+
+// SetPattern uploads a digital pattern to slot, selects it on channel ch and, if a bit rate was given, sets the frequency to match
+func (mhs5200 *MHS5200A) SetPattern(ch uint, slot uint, pattern *PATTERN) error {
+	if pattern == nil {
+		return fmt.Errorf("null pattern")
+	}
+	data, length, err := pattern.Render()
+	if err != nil {
+		return err
+	}
+	err = mhs5200.setArbitraryWaveform(slot, data, "pattern "+pattern.String())
+	if err != nil {
+		return err
+	}
+	err = mhs5200.SetWaveform(ch, WAVEFORM_ARB_0+slot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pattern is %v bit periods long\n", length)
+	if pattern.Bitrate <= 0.0 {
+		return nil
+	}
+	frequency := pattern.Bitrate / length
+	fmt.Printf("Generator frequency for %v bit/s is %v\n", pattern.Bitrate, mhs5200.FrequencyString(frequency))
+	if frequency > ARB_WAVEFORM_MAX_FREQUENCY {
+		return fmt.Errorf("%v exceeds the maximum arbitrary waveform frequency of %v", mhs5200.FrequencyString(frequency), mhs5200.FrequencyString(ARB_WAVEFORM_MAX_FREQUENCY))
+	}
+	if pattern.Bitrate*0.5 > ARB_WAVEFORM_MAX_FREQUENCY {
+		goutils.Log.Printf("Warning: %v bit/s exceeds the %v arbitrary waveform bandwidth, edges will be rounded", pattern.Bitrate, mhs5200.FrequencyString(ARB_WAVEFORM_MAX_FREQUENCY))
+	}
+	return mhs5200.SetFrequency(ch, frequency)
+}
@@ -0,0 +1,437 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	PLOT_TERMINAL_WIDTH  = 100 // characters
+	PLOT_TERMINAL_HEIGHT = 16  // characters
+	PLOT_IMAGE_WIDTH     = 1000
+	PLOT_IMAGE_HEIGHT    = 500
+	PLOT_IMAGE_MARGIN    = 60
+	PLOT_NUM_TICKS       = 4
+)
+
+// plotASCII selects plain ASCII instead of braille characters for terminal plots
+var plotASCII = false
+
+// plotFile is an svg or png image file plots are also written to, set by -plotfile
+var plotFile = ""
+
+type PLOT struct {
+	Title  string
+	XLabel string
+	YLabel string
+	X      []float64
+	Y      []float64
+	Xmin   float64
+	Xmax   float64
+	Ymin   float64
+	Ymax   float64
+	Bars   bool // draw vertical bars up from Ymin instead of joining the points, used for spectra
+}
+
+// plotter is implemented by the terminal, svg and png back ends
+type plotter interface {
+	dot(x int, y int)
+}
+
+func tickLabel(v float64) string {
+	if math.Abs(v) < 1e-12 {
+		v = 0.0
+	}
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+func (plot *PLOT) ticks(vmin float64, vmax float64) []float64 {
+	ticks := make([]float64, PLOT_NUM_TICKS+1)
+	for i := range ticks {
+		ticks[i] = vmin + (vmax-vmin)*float64(i)/PLOT_NUM_TICKS
+	}
+	return ticks
+}
+
+// scale maps a data point to integer coordinates in a width x height area, origin top left
+func (plot *PLOT) scale(x float64, y float64, width int, height int) (int, int) {
+	px := (x - plot.Xmin) / (plot.Xmax - plot.Xmin) * float64(width-1)
+	py := (plot.Ymax - y) / (plot.Ymax - plot.Ymin) * float64(height-1)
+	px = math.Max(0, math.Min(float64(width-1), px))
+	py = math.Max(0, math.Min(float64(height-1), py))
+	return int(math.Round(px)), int(math.Round(py))
+}
+
+func drawLine(p plotter, x0 int, y0 int, x1 int, y1 int) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy > 0 {
+		dy = -dy
+	}
+	sx := 1
+	if x0 > x1 {
+		sx = -1
+	}
+	sy := 1
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		p.dot(x0, y0)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+// trace draws the data of the plot into a width x height dot area
+func (plot *PLOT) trace(p plotter, width int, height int) {
+	for i := range plot.Y {
+		x, y := plot.scale(plot.X[i], plot.Y[i], width, height)
+		if plot.Bars {
+			_, y0 := plot.scale(plot.X[i], plot.Ymin, width, height)
+			drawLine(p, x, y0, x, y)
+		} else if i > 0 {
+			x0, y0 := plot.scale(plot.X[i-1], plot.Y[i-1], width, height)
+			drawLine(p, x0, y0, x, y)
+		} else {
+			p.dot(x, y)
+		}
+	}
+}
+
+type terminalPlot struct {
+	width  int
+	height int
+	dots   [][]bool
+}
+
+func (t *terminalPlot) dot(x int, y int) {
+	t.dots[y][x] = true
+}
+
+// braille dot bit for each position in a 2x4 character cell
+var brailleDots = [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+
+// Terminal renders the plot using braille characters, or plain ASCII if plotASCII is set
+func (plot *PLOT) Terminal(cols int, rows int) string {
+	cellw, cellh := 2, 4
+	if plotASCII {
+		cellw, cellh = 1, 1
+	}
+	t := terminalPlot{
+		width:  cols * cellw,
+		height: rows * cellh,
+	}
+	t.dots = make([][]bool, t.height)
+	for i := range t.dots {
+		t.dots[i] = make([]bool, t.width)
+	}
+	plot.trace(&t, t.width, t.height)
+
+	ylabels := map[int]string{
+		0:        tickLabel(plot.Ymax),
+		rows / 2: tickLabel((plot.Ymax + plot.Ymin) * 0.5),
+		rows - 1: tickLabel(plot.Ymin),
+	}
+	margin := 0
+	for _, s := range ylabels {
+		if len(s) > margin {
+			margin = len(s)
+		}
+	}
+	var b strings.Builder
+	if len(plot.Title) > 0 {
+		fmt.Fprintf(&b, "%*s  %s\n", margin, "", plot.Title)
+	}
+	for row := 0; row < rows; row++ {
+		fmt.Fprintf(&b, "%*s |", margin, ylabels[row])
+		for col := 0; col < cols; col++ {
+			if plotASCII {
+				if t.dots[row][col] {
+					b.WriteByte('*')
+				} else {
+					b.WriteByte(' ')
+				}
+				continue
+			}
+			r := rune(0x2800)
+			for dy := 0; dy < cellh; dy++ {
+				for dx := 0; dx < cellw; dx++ {
+					if t.dots[row*cellh+dy][col*cellw+dx] {
+						r |= brailleDots[dy][dx]
+					}
+				}
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "%*s +%s\n", margin, "", strings.Repeat("-", cols))
+	xmin := tickLabel(plot.Xmin)
+	xmax := tickLabel(plot.Xmax)
+	fmt.Fprintf(&b, "%*s  %s%*s\n", margin, "", xmin, cols-len(xmin), xmax)
+	if len(plot.XLabel) > 0 {
+		fmt.Fprintf(&b, "%*s  %*s\n", margin, "", (cols+len(plot.XLabel))/2, plot.XLabel)
+	}
+	return b.String()
+}
+
+// SVG renders the plot as an svg image with axes
+func (plot *PLOT) SVG() []byte {
+	w, h, m := PLOT_IMAGE_WIDTH, PLOT_IMAGE_HEIGHT, PLOT_IMAGE_MARGIN
+	pw, ph := w-2*m, h-2*m
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", w, h, w, h)
+	fmt.Fprintf(&b, "<rect width=\"%d\" height=\"%d\" fill=\"white\"/>\n", w, h)
+	fmt.Fprintf(&b, "<g font-family=\"sans-serif\" font-size=\"12\" fill=\"black\">\n")
+	for _, v := range plot.ticks(plot.Xmin, plot.Xmax) {
+		x, _ := plot.scale(v, plot.Ymin, pw, ph)
+		fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"#ddd\"/>\n", m+x, m, m+x, m+ph)
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%s</text>\n", m+x, m+ph+18, tickLabel(v))
+	}
+	for _, v := range plot.ticks(plot.Ymin, plot.Ymax) {
+		_, y := plot.scale(plot.Xmin, v, pw, ph)
+		fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"#ddd\"/>\n", m, m+y, m+pw, m+y)
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\">%s</text>\n", m-6, m+y+4, tickLabel(v))
+	}
+	fmt.Fprintf(&b, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"none\" stroke=\"black\"/>\n", m, m, pw, ph)
+	if len(plot.Title) > 0 {
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\" font-size=\"16\">%s</text>\n", w/2, m/2, svgEscape(plot.Title))
+	}
+	if len(plot.XLabel) > 0 {
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%s</text>\n", w/2, h-m/4, svgEscape(plot.XLabel))
+	}
+	if len(plot.YLabel) > 0 {
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\" transform=\"rotate(-90 %d %d)\">%s</text>\n", m/4, h/2, m/4, h/2, svgEscape(plot.YLabel))
+	}
+	fmt.Fprintf(&b, "</g>\n")
+	if plot.Bars {
+		for i := range plot.Y {
+			x, y := plot.scale(plot.X[i], plot.Y[i], pw, ph)
+			_, y0 := plot.scale(plot.X[i], plot.Ymin, pw, ph)
+			fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"blue\" stroke-width=\"2\"/>\n", m+x, m+y0, m+x, m+y)
+		}
+	} else {
+		fmt.Fprintf(&b, "<polyline fill=\"none\" stroke=\"blue\" stroke-width=\"1\" points=\"")
+		for i := range plot.Y {
+			px := float64(m) + (plot.X[i]-plot.Xmin)/(plot.Xmax-plot.Xmin)*float64(pw)
+			py := float64(m) + (plot.Ymax-plot.Y[i])/(plot.Ymax-plot.Ymin)*float64(ph)
+			fmt.Fprintf(&b, "%.2f,%.2f ", px, py)
+		}
+		fmt.Fprintf(&b, "\"/>\n")
+	}
+	fmt.Fprintf(&b, "</svg>\n")
+	return b.Bytes()
+}
+
+func svgEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+type imagePlot struct {
+	img    *image.RGBA
+	xoff   int
+	yoff   int
+	colour color.RGBA
+}
+
+func (p *imagePlot) dot(x int, y int) {
+	p.img.SetRGBA(p.xoff+x, p.yoff+y, p.colour)
+}
+
+// 3x5 pixel glyphs for the tick labels of png plots, one row per byte, msb is the left column
+var plotGlyphs = map[rune][5]byte{
+	'0': {0x7, 0x5, 0x5, 0x5, 0x7},
+	'1': {0x2, 0x6, 0x2, 0x2, 0x7},
+	'2': {0x7, 0x1, 0x7, 0x4, 0x7},
+	'3': {0x7, 0x1, 0x7, 0x1, 0x7},
+	'4': {0x5, 0x5, 0x7, 0x1, 0x1},
+	'5': {0x7, 0x4, 0x7, 0x1, 0x7},
+	'6': {0x7, 0x4, 0x7, 0x5, 0x7},
+	'7': {0x7, 0x1, 0x1, 0x1, 0x1},
+	'8': {0x7, 0x5, 0x7, 0x5, 0x7},
+	'9': {0x7, 0x5, 0x7, 0x1, 0x7},
+	'.': {0x0, 0x0, 0x0, 0x0, 0x2},
+	'-': {0x0, 0x0, 0x7, 0x0, 0x0},
+	'+': {0x0, 0x2, 0x7, 0x2, 0x0},
+	'e': {0x0, 0x7, 0x7, 0x4, 0x7},
+}
+
+// drawText draws s with its top right corner at x, y using the built in glyphs, scaled by 2
+func (p *imagePlot) drawText(s string, x int, y int) {
+	const scale = 2
+	x -= len(s) * 4 * scale
+	for _, r := range s {
+		glyph, ok := plotGlyphs[r]
+		if ok {
+			for row := 0; row < 5; row++ {
+				for col := 0; col < 3; col++ {
+					if glyph[row]&(0x4>>uint(col)) == 0 {
+						continue
+					}
+					for sy := 0; sy < scale; sy++ {
+						for sx := 0; sx < scale; sx++ {
+							p.img.SetRGBA(x+col*scale+sx, y+row*scale+sy, p.colour)
+						}
+					}
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+// PNG renders the plot as a png image with axes, only the tick labels are drawn as text
+func (plot *PLOT) PNG() ([]byte, error) {
+	w, h, m := PLOT_IMAGE_WIDTH, PLOT_IMAGE_HEIGHT, PLOT_IMAGE_MARGIN
+	pw, ph := w-2*m, h-2*m
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	p := imagePlot{img: img, colour: color.RGBA{0xdd, 0xdd, 0xdd, 0xff}}
+	text := imagePlot{img: img, colour: color.RGBA{0, 0, 0, 0xff}}
+	for _, v := range plot.ticks(plot.Xmin, plot.Xmax) {
+		x, _ := plot.scale(v, plot.Ymin, pw, ph)
+		drawLine(&p, m+x, m, m+x, m+ph)
+		s := tickLabel(v)
+		text.drawText(s, m+x+len(s)*4, m+ph+8)
+	}
+	for _, v := range plot.ticks(plot.Ymin, plot.Ymax) {
+		_, y := plot.scale(plot.Xmin, v, pw, ph)
+		drawLine(&p, m, m+y, m+pw, m+y)
+		text.drawText(tickLabel(v), m-6, m+y-5)
+	}
+	drawLine(&text, m, m, m+pw, m)
+	drawLine(&text, m+pw, m, m+pw, m+ph)
+	drawLine(&text, m+pw, m+ph, m, m+ph)
+	drawLine(&text, m, m+ph, m, m)
+	trace := imagePlot{img: img, xoff: m, yoff: m, colour: color.RGBA{0, 0, 0xff, 0xff}}
+	plot.trace(&trace, pw, ph)
+	var b bytes.Buffer
+	err := png.Encode(&b, img)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteImage writes the plot to filename, the format is selected by the .svg or .png extension
+func (plot *PLOT) WriteImage(filename string) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".svg":
+		data = plot.SVG()
+
+	case ".png":
+		data, err = plot.PNG()
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("%v: unsupported image format, use .svg or .png", filename)
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// previewArbitraryWaveform plots the waveform in filename exactly as the generator's 12 bit DAC will output it.
+// Files that are not ready for upload are normalised the same way the convert command does.
+func previewArbitraryWaveform(filename string, transforms []TRANSFORM, imagefile string) error {
+	title := filepath.Base(filename)
+	data, err := loadArbitraryWaveformFile(filename)
+	if err != nil {
+		var nerr error
+		data, nerr = normaliseWaveFile(filename)
+		if nerr != nil || len(data) != ARB_WAVEFORM_NUM_POINTS {
+			return err
+		}
+		title += " (normalised)"
+	}
+	if len(transforms) > 0 {
+		data, err = applyTransforms(data, transforms)
+		if err != nil {
+			return err
+		}
+		title += " " + transformsString(transforms)
+	}
+	samples := quantiseArbitraryWaveform(data)
+	plot := PLOT{
+		Title:  title + ", 12 bit quantised",
+		XLabel: "sample",
+		YLabel: "amplitude",
+		X:      make([]float64, len(samples)),
+		Y:      make([]float64, len(samples)),
+		Xmin:   0,
+		Xmax:   ARB_WAVEFORM_NUM_POINTS - 1,
+		Ymin:   ARB_WAVEFORM_INPUT_MIN,
+		Ymax:   ARB_WAVEFORM_INPUT_MAX,
+	}
+	for i, v := range samples {
+		plot.X[i] = float64(i)
+		plot.Y[i] = arbitraryWaveformToNormalised(v)
+	}
+	fmt.Print(plot.Terminal(PLOT_TERMINAL_WIDTH, PLOT_TERMINAL_HEIGHT))
+	if len(imagefile) > 0 {
+		return plot.WriteImage(imagefile)
+	}
+	return nil
+}
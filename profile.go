@@ -0,0 +1,386 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const PROFILE_TOLERANCE = 1e-9 // volts and Hz, so a limit given exactly is not rounded over
+
+var profileName = ""      // set by -profile
+var profilesFilename = "" // set by -profiles
+
+// LIMITS are the largest output a device under test tolerates, zero values are
+// not limited. The envelope is how far the output swings from ground, the
+// absolute offset plus half the peak to peak amplitude. Waveforms lists the
+// waveforms allowed, arbitrary allows every arbitrary slot and with it library,
+// sinc and generated waveforms
+type LIMITS struct {
+	MaxAmplitude float64  `json:"maxamplitude,omitempty"` // volts peak to peak
+	MaxEnvelope  float64  `json:"maxenvelope,omitempty"`  // volts
+	MinFrequency float64  `json:"minfrequency,omitempty"` // Hz
+	MaxFrequency float64  `json:"maxfrequency,omitempty"` // Hz
+	Waveforms    []string `json:"waveforms,omitempty"`
+}
+
+// PROFILE protects a device under test by limiting what the MHS-5200A outputs.
+// The limits apply to both channels unless Channels, keyed by channel number,
+// replaces them for a channel. Offending settings are rejected, or brought
+// within the limits when Clamp is set
+type PROFILE struct {
+	Name        string `json:"-"`
+	Description string `json:"description,omitempty"`
+	Clamp       bool   `json:"clamp,omitempty"`
+	LIMITS
+	Channels map[string]LIMITS `json:"channels,omitempty"`
+}
+
+var builtinProfiles = map[string]PROFILE{
+	"mcu-3v3": {
+		Description: "3.3V microcontroller inputs",
+		LIMITS:      LIMITS{MaxAmplitude: 3.3, MaxEnvelope: 3.3},
+	},
+	"mcu-5v": {
+		Description: "5V microcontroller inputs",
+		LIMITS:      LIMITS{MaxAmplitude: 5.0, MaxEnvelope: 5.0},
+	},
+	"line-level": {
+		Description: "consumer audio line inputs",
+		LIMITS:      LIMITS{MaxAmplitude: 2.0, MaxEnvelope: 1.0, MaxFrequency: 100.0e03},
+	},
+}
+
+func defaultProfilesFilename() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mhs5200a", "profiles.json"), nil
+}
+
+// loadProfiles returns the built in profiles and those of the profiles file, a
+// profile in the file replaces a built in one of the same name
+func loadProfiles() (map[string]PROFILE, error) {
+	profiles := make(map[string]PROFILE)
+	for name, profile := range builtinProfiles {
+		profiles[name] = profile
+	}
+	filename := profilesFilename
+	if len(filename) == 0 {
+		var err error
+		filename, err = defaultProfilesFilename()
+		if err != nil {
+			return profiles, nil
+		}
+	}
+	jsn, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) && len(profilesFilename) == 0 {
+			return profiles, nil
+		}
+		return nil, err
+	}
+	var user map[string]PROFILE
+	err = json.Unmarshal(jsn, &user)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	for name, profile := range user {
+		for ch := range profile.Channels {
+			if ch != "1" && ch != "2" {
+				return nil, fmt.Errorf("%v: profile %v has limits for channel %v", filename, name, ch)
+			}
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// loadProfile returns the profile called name
+func loadProfile(name string) (*PROFILE, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown profile %v, known profiles are %v", name, strings.Join(names, ", "))
+	}
+	profile.Name = name
+	return &profile, nil
+}
+
+// selectProfile returns the profile given by -profile, or else the one named by
+// a script, nil when there is neither
+func selectProfile(script string) (*PROFILE, error) {
+	name := profileName
+	if len(name) == 0 {
+		name = script
+	}
+	if len(name) == 0 {
+		return nil, nil
+	}
+	return loadProfile(name)
+}
+
+// limits returns the limits of channel ch
+func (profile *PROFILE) limits(ch uint) *LIMITS {
+	if l, ok := profile.Channels[strconv.Itoa(int(ch))]; ok {
+		return &l
+	}
+	return &profile.LIMITS
+}
+
+// SetProfile makes the instrument enforce the limits of profile, nil removes them
+func (mhs5200 *MHS5200A) SetProfile(profile *PROFILE) {
+	mhs5200.profile = profile
+}
+
+// exceeded rejects a value outside the limits of the profile, or returns the
+// limit to use instead when the profile clamps. with tells what else the limit
+// depends on
+func (mhs5200 *MHS5200A) exceeded(what string, v float64, limit float64, units string, with string) (float64, error) {
+	if !mhs5200.profile.Clamp {
+		return v, fmt.Errorf("%v %.6g%v%v is beyond the %.6g%v limit of profile %v", what, v, units, with, limit, units, mhs5200.profile.Name)
+	}
+	goutils.Log.Printf("%v %.6g%v%v clamped to %.6g%v by profile %v", what, v, units, with, limit, units, mhs5200.profile.Name)
+	return limit, nil
+}
+
+// limitFrequency checks a frequency against the profile
+func (mhs5200 *MHS5200A) limitFrequency(ch uint, v float64) (float64, error) {
+	if mhs5200.profile == nil {
+		return v, nil
+	}
+	l := mhs5200.profile.limits(ch)
+	what := fmt.Sprintf("channel %v frequency", ch)
+	if l.MaxFrequency > 0 && v > l.MaxFrequency+PROFILE_TOLERANCE {
+		return mhs5200.exceeded(what, v, l.MaxFrequency, "Hz", "")
+	}
+	if l.MinFrequency > 0 && v < l.MinFrequency-PROFILE_TOLERANCE {
+		return mhs5200.exceeded(what, v, l.MinFrequency, "Hz", "")
+	}
+	return v, nil
+}
+
+// limitWaveform checks a waveform against the profile, a waveform that is not
+// allowed cannot be clamped and is always rejected
+func (mhs5200 *MHS5200A) limitWaveform(ch uint, name string) error {
+	if mhs5200.profile == nil {
+		return nil
+	}
+	l := mhs5200.profile.limits(ch)
+	if len(l.Waveforms) == 0 {
+		return nil
+	}
+	for _, w := range l.Waveforms {
+		if w == name || (w == WAVEFORM_ARB_STR && strings.HasPrefix(name, WAVEFORM_ARB_STR)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("channel %v waveform %v is not allowed by profile %v, allowed waveforms are %v", ch, name, mhs5200.profile.Name, strings.Join(l.Waveforms, ", "))
+}
+
+// limitAmplitude checks an amplitude against the profile. The instrument keeps
+// the offset as a percentage of the amplitude, so the envelope uses the
+// amplitude with the offset scaled to it
+func (mhs5200 *MHS5200A) limitAmplitude(ch uint, v float64) (float64, error) {
+	if mhs5200.profile == nil {
+		return v, nil
+	}
+	l := mhs5200.profile.limits(ch)
+	what := fmt.Sprintf("channel %v amplitude", ch)
+	var err error
+	if l.MaxAmplitude > 0 && v > l.MaxAmplitude+PROFILE_TOLERANCE {
+		v, err = mhs5200.exceeded(what, v, l.MaxAmplitude, "V", "")
+		if err != nil {
+			return v, err
+		}
+	}
+	if l.MaxEnvelope > 0 {
+		ratio, err := mhs5200.offsetRatio(ch)
+		if err != nil {
+			return v, err
+		}
+		scale := math.Abs(ratio) + 0.5
+		if v*scale > l.MaxEnvelope+PROFILE_TOLERANCE {
+			with := fmt.Sprintf(" with a %v%% offset", math.Round(ratio*100.0))
+			return mhs5200.exceeded(what, v, l.MaxEnvelope/scale, "V", with)
+		}
+	}
+	return v, nil
+}
+
+// limitOffset checks an offset against the profile, given the amplitude
+func (mhs5200 *MHS5200A) limitOffset(ch uint, v float64, ampl float64) (float64, error) {
+	if mhs5200.profile == nil {
+		return v, nil
+	}
+	l := mhs5200.profile.limits(ch)
+	if l.MaxEnvelope <= 0 || math.Abs(v)+ampl/2.0 <= l.MaxEnvelope+PROFILE_TOLERANCE {
+		return v, nil
+	}
+	limit := l.MaxEnvelope - ampl/2.0
+	if limit < 0 {
+		return v, fmt.Errorf("channel %v amplitude %.6gV already exceeds the %.6gV envelope of profile %v", ch, ampl, l.MaxEnvelope, mhs5200.profile.Name)
+	}
+	what := fmt.Sprintf("channel %v offset", ch)
+	with := fmt.Sprintf(" with a %.6gV amplitude", ampl)
+	offset, err := mhs5200.exceeded(what, math.Abs(v), limit, "V", with)
+	return math.Copysign(offset, v), err
+}
+
+// offsetRatio returns the offset of channel ch as a fraction of its amplitude
+func (mhs5200 *MHS5200A) offsetRatio(ch uint) (float64, error) {
+	data, err := mhs5200.sendCommand([]byte(fmt.Sprintf(":r%do", ch)))
+	if err != nil {
+		return 0.0, err
+	}
+	if len(data) < 4 {
+		return 0.0, fmt.Errorf("data underlow")
+	}
+	v, err := strconv.ParseFloat(string(data[4:]), 64)
+	if err != nil {
+		return 0.0, err
+	}
+	return (v - 120.0) / 100.0, nil
+}
+
+// limitAttenuationOff checks turning the attenuator of channel ch off, which
+// multiplies its amplitude by 10. A profile that clamps lowers the amplitude first
+func (mhs5200 *MHS5200A) limitAttenuationOff(ch uint) error {
+	if mhs5200.profile == nil {
+		return nil
+	}
+	attenuation, err := mhs5200.GetAttenuation(ch)
+	if err != nil || attenuation == ATTENUATION_0DB {
+		return err
+	}
+	ampl, err := mhs5200.GetAmplitude(ch)
+	if err != nil {
+		return err
+	}
+	limited, err := mhs5200.limitAmplitude(ch, ampl*10.0)
+	if err != nil {
+		return fmt.Errorf("turning the attenuator off: %v", err)
+	}
+	if limited < ampl*10.0 {
+		return mhs5200.SetAmplitude(ch, limited/10.0)
+	}
+	return nil
+}
+
+// limitSettings checks the configuration of both channels against the profile
+// after it was set without going through the limits, by loading a saved
+// configuration or restoring a checkpoint. Values the profile clamps are set to
+// their limits
+func (mhs5200 *MHS5200A) limitSettings() error {
+	if mhs5200.profile == nil {
+		return nil
+	}
+	for ch := uint(1); ch <= 2; ch++ {
+		w, err := mhs5200.GetWaveform(ch)
+		if err != nil {
+			return err
+		}
+		err = mhs5200.limitWaveform(ch, mhs5200.WaveformString(w))
+		if err != nil {
+			return err
+		}
+		f, err := mhs5200.GetFrequency(ch)
+		if err != nil {
+			return err
+		}
+		limited, err := mhs5200.limitFrequency(ch, f)
+		if err != nil {
+			return err
+		}
+		if limited != f {
+			err = mhs5200.SetFrequency(ch, limited)
+			if err != nil {
+				return err
+			}
+		}
+		ampl, err := mhs5200.GetAmplitude(ch)
+		if err != nil {
+			return err
+		}
+		limited, err = mhs5200.limitAmplitude(ch, ampl)
+		if err != nil {
+			return err
+		}
+		if limited != ampl {
+			err = mhs5200.SetAmplitude(ch, limited)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// limitChannelConfig checks the amplitude and offset of a channel configuration
+// together before any of it is sent, and clamps them in v when the profile does
+func (mhs5200 *MHS5200A) limitChannelConfig(v *CHANNELVALS) error {
+	if mhs5200.profile == nil || math.IsNaN(v.Amplitude) || math.IsNaN(v.Offset) {
+		return nil
+	}
+	var err error
+	l := mhs5200.profile.limits(v.Channel)
+	if l.MaxAmplitude > 0 && v.Amplitude > l.MaxAmplitude+PROFILE_TOLERANCE {
+		v.Amplitude, err = mhs5200.exceeded(fmt.Sprintf("channel %v amplitude", v.Channel), v.Amplitude, l.MaxAmplitude, "V", "")
+		if err != nil {
+			return err
+		}
+	}
+	v.Offset, err = mhs5200.limitOffset(v.Channel, v.Offset, v.Amplitude)
+	return err
+}
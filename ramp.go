@@ -0,0 +1,293 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	RAMP_STEP_INTERVAL = 100 * time.Millisecond // time between steps when no step size is given
+	RAMP_MIN_AMPLITUDE = 0.01                   // volts, where automatic ramps start and end
+)
+
+var autoRamp = time.Duration(0) // set by -autoramp
+
+var rampParams = []string{"amplitude", "offset", "frequency"}
+
+// RAMP walks one parameter of a channel from one value to another
+type RAMP struct {
+	ch    uint
+	param string
+	from  float64
+	to    float64
+}
+
+// parseDuration parses a duration given as [[HH:]MM:]SS, a number of seconds or a
+// duration such as 1m30s
+func parseDuration(s string) (time.Duration, error) {
+	d, err := parseOffset(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration %v", s)
+	}
+	return d, nil
+}
+
+// setRampParam sets a parameter that can be ramped using its setter, so limit
+// profiles apply to every step
+func (mhs5200 *MHS5200A) setRampParam(ch uint, param string, v float64) error {
+	switch param {
+	case "amplitude":
+		return mhs5200.SetAmplitude(ch, v)
+	case "offset":
+		return mhs5200.SetOffset(ch, v)
+	case "frequency":
+		return mhs5200.SetFrequency(ch, v)
+	}
+	return fmt.Errorf("%v cannot be ramped, valid parameters are amplitude, offset and frequency", param)
+}
+
+// rampAttenuation turns the -20dB attenuator off before an amplitude ramp that goes
+// above 2V, the largest amplitude it allows, so the attenuation is chosen once rather
+// than failing partway. A tenth of from is set first, turning the attenuator off
+// brings the output up to it
+func (mhs5200 *MHS5200A) rampAttenuation(r RAMP) error {
+	if r.param != "amplitude" || math.Max(r.from, r.to) <= ATTENUATED_MAX_AMPLITUDE {
+		return nil
+	}
+	attenuation, err := mhs5200.GetAttenuation(r.ch)
+	if err != nil {
+		return err
+	}
+	if attenuation != ATTENUATION_MINUS_20DB {
+		return nil
+	}
+	err = mhs5200.SetAmplitude(r.ch, math.Max(r.from/10.0, 5e-3))
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetAttenuation(r.ch, ATTENUATION_0DB)
+}
+
+// getRampParam returns the current value of a parameter that can be ramped
+func (mhs5200 *MHS5200A) getRampParam(ch uint, param string) (float64, error) {
+	switch param {
+	case "amplitude":
+		return mhs5200.GetAmplitude(ch)
+	case "offset":
+		return mhs5200.GetOffset(ch)
+	case "frequency":
+		return mhs5200.GetFrequency(ch)
+	}
+	return math.NaN(), fmt.Errorf("%v cannot be ramped, valid parameters are amplitude, offset and frequency", param)
+}
+
+// Ramp walks the parameters of ramps from their from to their to values together
+// over d, in steps of at most step, or every RAMP_STEP_INTERVAL when step is 0.
+// Steps are timed from the start, so the time taken to send them does not stretch
+// the ramp. Without a step size, steps the instrument is too slow for are skipped
+func (mhs5200 *MHS5200A) Ramp(ramps []RAMP, d time.Duration, step float64) error {
+	steps := int(d / RAMP_STEP_INTERVAL)
+	if step > 0 {
+		steps = 0
+		for _, r := range ramps {
+			n := int(math.Ceil(math.Abs(r.to-r.from)/step - PROFILE_TOLERANCE))
+			if n > steps {
+				steps = n
+			}
+		}
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	for _, r := range ramps {
+		err := mhs5200.rampAttenuation(r)
+		if err != nil {
+			return err
+		}
+	}
+	start := mhs5200.now()
+	for i := 0; ; i++ {
+		for _, r := range ramps {
+			v := r.from + (r.to-r.from)*float64(i)/float64(steps)
+			if i == steps {
+				v = r.to // no rounding error in the final value
+			}
+			err := mhs5200.setRampParam(r.ch, r.param, v)
+			if err != nil {
+				return err
+			}
+		}
+		if i == steps {
+			return nil
+		}
+		// in float seconds, d * (i+1) overflows the nanoseconds of a Duration on long ramps
+		next := start.Add(time.Duration(d.Seconds() * float64(i+1) / float64(steps) * float64(time.Second)))
+		if wait := next.Sub(mhs5200.now()); wait > 0 {
+			mhs5200.sleep(wait)
+		} else if step == 0 && d > 0 {
+			late := int(mhs5200.now().Sub(start).Seconds() * float64(steps) / d.Seconds())
+			if late >= steps {
+				late = steps - 1
+			}
+			if late > i {
+				i = late
+			}
+		}
+	}
+}
+
+// checkRamp rejects ramp parameters that cannot work
+func checkRamp(data *CMDPARAMS) error {
+	if data.Param != nil && !stringIn(*data.Param, rampParams) {
+		return fmt.Errorf("%v cannot be ramped, valid parameters are %v", *data.Param, strings.Join(rampParams, ", "))
+	}
+	if data.Duration != nil && data.Rate != nil {
+		return fmt.Errorf("duration and rate cannot both be given")
+	}
+	if data.Duration != nil {
+		_, err := parseDuration(*data.Duration)
+		if err != nil {
+			return err
+		}
+	}
+	if data.Rate != nil && *data.Rate <= 0 {
+		return fmt.Errorf("ramp rate must be greater than 0")
+	}
+	if data.Step != nil && *data.Step <= 0 {
+		return fmt.Errorf("ramp step must be greater than 0")
+	}
+	return nil
+}
+
+// rampCommand runs a ramp command, from defaults to the current value and the
+// duration can instead be given as a rate in units per second
+func rampCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	ch := state.ch(data)
+	err := checkRamp(data)
+	if err != nil {
+		return err
+	}
+	r := RAMP{ch: ch, param: *data.Param, to: *data.To}
+	if data.From != nil {
+		r.from = *data.From
+	} else {
+		r.from, err = state.mhs5200.getRampParam(ch, r.param)
+		if err != nil {
+			return err
+		}
+	}
+	var d time.Duration
+	if data.Duration != nil {
+		d, err = parseDuration(*data.Duration)
+		if err != nil {
+			return err
+		}
+	} else {
+		d = time.Duration(math.Abs(r.to-r.from) / *data.Rate * float64(time.Second))
+	}
+	step := 0.0
+	if data.Step != nil {
+		step = *data.Step
+	}
+	state.logf("Ramping channel %v %v from %v to %v over %v", ch, r.param, r.from, r.to, d)
+	return state.mhs5200.Ramp([]RAMP{r}, d, step)
+}
+
+// rampOnOff turns the outputs on or off. With an automatic ramp the amplitude of
+// both channels rises from RAMP_MIN_AMPLITUDE after the outputs are turned on, or
+// falls to it before they are turned off and is then set back, so the channel
+// configuration is unchanged
+func rampOnOff(state *COMMANDSTATE, on bool) error {
+	d := state.autoRamp
+	if d <= 0 {
+		return state.mhs5200.SetOnOff(on)
+	}
+	current, err := state.mhs5200.GetOnOff()
+	if err != nil {
+		return err
+	}
+	if current == on { // nothing to ramp
+		return state.mhs5200.SetOnOff(on)
+	}
+	ramps := make([]RAMP, 0, 2)
+	for ch := uint(1); ch <= 2; ch++ {
+		ampl, err := state.mhs5200.GetAmplitude(ch)
+		if err != nil {
+			return err
+		}
+		if ampl > RAMP_MIN_AMPLITUDE {
+			ramps = append(ramps, RAMP{ch: ch, param: "amplitude", from: RAMP_MIN_AMPLITUDE, to: ampl})
+		}
+	}
+	if on {
+		for _, r := range ramps {
+			err := state.mhs5200.SetAmplitude(r.ch, r.from)
+			if err != nil {
+				return err
+			}
+		}
+		err = state.mhs5200.SetOnOff(true)
+		if err != nil {
+			return err
+		}
+		state.logf("Ramping up over %v", d)
+		return state.mhs5200.Ramp(ramps, d, 0)
+	}
+	down := make([]RAMP, len(ramps))
+	for i, r := range ramps {
+		down[i] = RAMP{ch: r.ch, param: r.param, from: r.to, to: r.from}
+	}
+	state.logf("Ramping down over %v", d)
+	err = state.mhs5200.Ramp(down, d, 0)
+	if err != nil {
+		return err
+	}
+	err = state.mhs5200.SetOnOff(false)
+	if err != nil {
+		return err
+	}
+	for _, r := range ramps {
+		err = state.mhs5200.SetAmplitude(r.ch, r.to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
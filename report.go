@@ -0,0 +1,231 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+var scriptJUnitFile = "" // JUnit XML report written by playbackScript, set by -junit
+var scriptTAPFile = ""   // TAP report written by playbackScript, set by -tap
+
+type JUNITFAILURE struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type JUNITPROPERTY struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type JUNITPROPERTIES struct {
+	Property []JUNITPROPERTY `xml:"property"`
+}
+
+type JUNITTESTCASE struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr"`
+	Properties *JUNITPROPERTIES `xml:"properties,omitempty"`
+	Failure    *JUNITFAILURE    `xml:"failure,omitempty"`
+	Error      *JUNITFAILURE    `xml:"error,omitempty"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+type JUNITTESTSUITE struct {
+	XMLName    xml.Name         `xml:"testsuite"`
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr"`
+	Properties *JUNITPROPERTIES `xml:"properties,omitempty"`
+	Testcases  []JUNITTESTCASE  `xml:"testcase"`
+}
+
+type JUNITTESTSUITES struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Time       string           `xml:"time,attr"`
+	Testsuites []JUNITTESTSUITE `xml:"testsuite"`
+}
+
+func reportSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// limitsString formats the limits of an assert, leaving out unbounded ends
+func (r *SCRIPTRESULT) limitsString() string {
+	switch {
+	case math.IsInf(r.Low, -1) && math.IsInf(r.High, 1):
+		return ""
+	case math.IsInf(r.Low, -1):
+		return fmt.Sprintf("<= %v", r.High)
+	case math.IsInf(r.High, 1):
+		return fmt.Sprintf(">= %v", r.Low)
+	}
+	return fmt.Sprintf("[%v, %v]", r.Low, r.High)
+}
+
+// junitProperties wraps properties for the xml encoder, nil if there are none
+func junitProperties(props []JUNITPROPERTY) *JUNITPROPERTIES {
+	if len(props) == 0 {
+		return nil
+	}
+	return &JUNITPROPERTIES{Property: props}
+}
+
+// properties returns the configured, measured and limit values of a result
+func (r *SCRIPTRESULT) properties() []JUNITPROPERTY {
+	var props []JUNITPROPERTY
+	if len(r.Configured) > 0 {
+		props = append(props, JUNITPROPERTY{Name: "configured", Value: r.Configured})
+	}
+	if len(r.Measured) > 0 {
+		props = append(props, JUNITPROPERTY{Name: "measured", Value: strings.Join(r.Measured, ", ")})
+	}
+	if limits := r.limitsString(); r.Assert && len(limits) > 0 {
+		props = append(props, JUNITPROPERTY{Name: "limits", Value: limits})
+	}
+	return props
+}
+
+// junitReport builds a JUnit XML report with one test case per assert and named step
+func (player *SCRIPTPLAYER) junitReport() ([]byte, error) {
+	suite := JUNITTESTSUITE{
+		Name:      player.name,
+		Tests:     len(player.results),
+		Time:      reportSeconds(player.mhs5200.now().Sub(player.start)),
+		Timestamp: player.start.Format(time.RFC3339),
+	}
+	names := make([]string, 0, len(player.vars))
+	for name := range player.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var props []JUNITPROPERTY
+	for _, name := range names {
+		props = append(props, JUNITPROPERTY{Name: name, Value: fmt.Sprintf("%v", player.vars[name])})
+	}
+	suite.Properties = junitProperties(props)
+	for _, r := range player.results {
+		tc := JUNITTESTCASE{
+			Name:       r.Name,
+			Classname:  player.name,
+			Time:       reportSeconds(r.Duration),
+			Timestamp:  r.Time.Format(time.RFC3339),
+			Properties: junitProperties(r.properties()),
+		}
+		switch {
+		case r.Error:
+			suite.Errors++
+			tc.Error = &JUNITFAILURE{Message: r.Message, Text: r.Message}
+		case !r.Passed:
+			suite.Failures++
+			tc.Failure = &JUNITFAILURE{Message: r.Message, Text: r.Message}
+		}
+		suite.Testcases = append(suite.Testcases, tc)
+	}
+	suites := JUNITTESTSUITES{
+		Tests:      suite.Tests,
+		Failures:   suite.Failures,
+		Errors:     suite.Errors,
+		Time:       suite.Time,
+		Testsuites: []JUNITTESTSUITE{suite},
+	}
+	x, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(x, '\n')...), nil
+}
+
+// tapReport builds a TAP version 13 report with a YAML diagnostic block per test
+func (player *SCRIPTPLAYER) tapReport() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n")
+	fmt.Fprintf(&b, "1..%v\n", len(player.results))
+	for n, r := range player.results {
+		status := "ok"
+		if !r.Passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(&b, "%v %v - %v\n", status, n+1, r.Name)
+		fmt.Fprintf(&b, "  ---\n")
+		fmt.Fprintf(&b, "  timestamp: %v\n", r.Time.Format(time.RFC3339))
+		fmt.Fprintf(&b, "  duration_ms: %v\n", r.Duration.Milliseconds())
+		for _, p := range r.properties() {
+			fmt.Fprintf(&b, "  %v: %q\n", p.Name, p.Value)
+		}
+		if len(r.Message) > 0 {
+			fmt.Fprintf(&b, "  message: %q\n", r.Message)
+		}
+		fmt.Fprintf(&b, "  ...\n")
+	}
+	return []byte(b.String())
+}
+
+// writeReports writes the JUnit and TAP reports requested on the command line
+func (player *SCRIPTPLAYER) writeReports() error {
+	if len(scriptJUnitFile) > 0 {
+		x, err := player.junitReport()
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(scriptJUnitFile, x, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if len(scriptTAPFile) > 0 {
+		err := ioutil.WriteFile(scriptTAPFile, player.tapReport(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
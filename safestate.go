@@ -0,0 +1,204 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/peterska/go-utils"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// actions of the safe state, applied in this order
+const (
+	SAFE_OUTPUTS_OFF   = "off"       // turn the outputs off
+	SAFE_SWEEP_OFF     = "sweep"     // stop the sweep
+	SAFE_MIN_AMPLITUDE = "amplitude" // set both channels to their minimum amplitude
+	SAFE_COUNTER_OFF   = "counter"   // stop the counter
+	SAFE_NONE          = "none"      // -safe-state none disables the safe state
+)
+
+var safeActions = []string{SAFE_OUTPUTS_OFF, SAFE_SWEEP_OFF, SAFE_MIN_AMPLITUDE, SAFE_COUNTER_OFF}
+
+var safeState = safeActions // set by -safe-state
+
+// errSafeState is returned for settings sent after the safe state was applied
+var errSafeState = fmt.Errorf("the MHS-5200A is in its safe state")
+
+// openDevices holds the instruments that have to be put in the safe state when the
+// program is interrupted or exits with an error
+var openDevices = struct {
+	sync.Mutex
+	devices map[*MHS5200A]bool
+}{devices: make(map[*MHS5200A]bool)}
+
+func trackDevice(mhs5200 *MHS5200A) {
+	openDevices.Lock()
+	defer openDevices.Unlock()
+	openDevices.devices[mhs5200] = true
+}
+
+func forgetDevice(mhs5200 *MHS5200A) {
+	openDevices.Lock()
+	defer openDevices.Unlock()
+	delete(openDevices.devices, mhs5200)
+}
+
+// parseSafeState parses the comma separated actions given to -safe-state
+func parseSafeState(s string) ([]string, error) {
+	if strings.TrimSpace(s) == SAFE_NONE {
+		return nil, nil
+	}
+	var actions []string
+	for _, action := range strings.Split(s, ",") {
+		action = strings.TrimSpace(action)
+		known := false
+		for _, a := range safeActions {
+			known = known || a == action
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown safe state action %v, valid actions are %v or %v", action, strings.Join(safeActions, ", "), SAFE_NONE)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// ApplySafeState puts the instrument in a safe state by carrying out actions in
+// order. Every action is attempted even if an earlier one fails, and the first
+// error is returned. The mutex is held throughout so no other command can undo an
+// action, and settings sent afterwards are refused
+func (mhs5200 *MHS5200A) ApplySafeState(actions []string) error {
+	mhs5200.mutex.Lock()
+	defer mhs5200.mutex.Unlock()
+	if mhs5200.safe || len(actions) == 0 {
+		return nil
+	}
+	mhs5200.safe = true
+	var firsterr error
+	send := func(cmd string) {
+		data, err := mhs5200.exchange([]byte(cmd))
+		if err == nil && string(data) != "ok" {
+			err = fmt.Errorf("Expected ok, got %v for %v", string(data), cmd)
+		}
+		if err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+	for _, action := range safeActions {
+		if !stringIn(action, actions) {
+			continue
+		}
+		switch action {
+		case SAFE_OUTPUTS_OFF:
+			send(":s1b0")
+
+		case SAFE_SWEEP_OFF:
+			send(":s8b0")
+
+		case SAFE_MIN_AMPLITUDE:
+			for ch := uint(1); ch <= 2; ch++ {
+				// amplitude is in mV when attenuated, 10mV units otherwise
+				v := 1
+				data, err := mhs5200.exchange([]byte(fmt.Sprintf(":r%dy", ch)))
+				if err == nil && len(data) > 4 {
+					if a, perr := strconv.ParseUint(string(data[4:]), 10, 32); perr == nil && a == ATTENUATION_MINUS_20DB {
+						v = 5
+					}
+				}
+				send(fmt.Sprintf(":s%da%d", ch, v))
+			}
+
+		case SAFE_COUNTER_OFF:
+			mhs5200.measure = false
+			send(":s6b0")
+		}
+	}
+	return firsterr
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applySafeStates puts every open instrument in the safe state
+func applySafeStates() {
+	openDevices.Lock()
+	devices := make([]*MHS5200A, 0, len(openDevices.devices))
+	for mhs5200 := range openDevices.devices {
+		devices = append(devices, mhs5200)
+	}
+	openDevices.Unlock()
+	for _, mhs5200 := range devices {
+		err := mhs5200.ApplySafeState(safeState)
+		if err != nil {
+			goutils.Log.Printf("%v: %v", goutils.Funcname(), err)
+		}
+	}
+}
+
+// safeExit puts every open instrument in the safe state and exits, os.Exit on its
+// own would skip the deferred Close and leave the outputs as they were
+func safeExit(code int) {
+	applySafeStates()
+	os.Exit(code)
+}
+
+// handleInterrupts applies the safe state when the program is interrupted or
+// terminated. A second interrupt while that is under way exits immediately
+func handleInterrupts() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-c
+		signal.Reset()
+		fmt.Printf("\n%v: %v, applying the safe state\n", timestampString(), sig)
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		safeExit(code)
+	}()
+}
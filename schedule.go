@@ -0,0 +1,459 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SCRIPT_LATE_THRESHOLD = time.Second // steps running later than this are reported
+	CRON_MAX_SEARCH_YEARS = 5
+)
+
+// cronMacros are the crontab shorthands for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// CRONSPEC is a parsed crontab schedule. Each field is a bit mask of the allowed
+// values, anyDom and anyDow record a * day of month or day of week
+type CRONSPEC struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDom bool
+	anyDow bool
+}
+
+// CRONJOB is a script run by the cron daemon and the next time it is due
+type CRONJOB struct {
+	spec   CRONSPEC
+	when   string
+	script string
+	next   time.Time
+}
+
+// parseOffset parses an offset from the start of a script given as [[HH:]MM:]SS,
+// a number of seconds or a duration such as 1h30m
+func parseOffset(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var d time.Duration
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("Invalid offset %v", s)
+		}
+		secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid offset %v", s)
+		}
+		d = time.Duration(secs * float64(time.Second))
+		unit := time.Minute
+		for i := len(parts) - 2; i >= 0; i-- {
+			v, err := strconv.ParseUint(parts[i], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid offset %v", s)
+			}
+			d += time.Duration(v) * unit
+			unit = time.Hour
+		}
+	} else if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		d = time.Duration(secs * float64(time.Second))
+	} else {
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid offset %v", s)
+		}
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("Invalid offset %v, offsets cannot be negative", s)
+	}
+	return d, nil
+}
+
+// parseClock returns the time the wall clock shows s. A time of day, HH:MM or
+// HH:MM:SS, is its next occurrence at or after now. A date and time, as
+// 2006-01-02 15:04[:05] or RFC 3339, may lie in the past
+func parseClock(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err == nil {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+			if t.Before(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid clock time %v", s)
+}
+
+// schedule waits until the time a command is scheduled for, an offset from the
+// start of the script given by at or a wall clock time given by clock. A step
+// that is already late runs straight away
+func (player *SCRIPTPLAYER) schedule(cmd CMD) error {
+	if len(cmd.At) == 0 && len(cmd.Clock) == 0 {
+		return nil
+	}
+	if len(cmd.At) > 0 && len(cmd.Clock) > 0 {
+		return fmt.Errorf("%v: at and clock cannot both be given", cmd.Cmd)
+	}
+	now := player.mhs5200.now()
+	var target time.Time
+	if len(cmd.At) > 0 {
+		at, err := expandExpressions(cmd.At, player.vars)
+		if err != nil {
+			return fmt.Errorf("%v: %v", cmd.Cmd, err)
+		}
+		offset, err := parseOffset(at)
+		if err != nil {
+			return fmt.Errorf("%v: %v", cmd.Cmd, err)
+		}
+		target = player.start.Add(offset)
+	} else {
+		var err error
+		target, err = parseClock(cmd.Clock, now)
+		if err != nil {
+			return fmt.Errorf("%v: %v", cmd.Cmd, err)
+		}
+	}
+	if target.After(now) {
+		fmt.Printf("%v: Waiting until %v\n", timestampString(), target.Format(time.Stamp))
+		player.mhs5200.sleep(target.Sub(now))
+	} else if late := now.Sub(target); late >= SCRIPT_LATE_THRESHOLD {
+		fmt.Printf("%v: %v is running %v late\n", timestampString(), cmd.Cmd, late.Round(time.Millisecond))
+	}
+	player.state.timeline = target
+	return nil
+}
+
+// wait sleeps for d. When compensating for drift d is counted from where the
+// previous wait or scheduled step should have ended, so the time taken by the
+// commands in between does not add up over a long script
+func (state *COMMANDSTATE) wait(d time.Duration) {
+	if !state.compensate {
+		state.mhs5200.sleep(d)
+		return
+	}
+	now := state.mhs5200.now()
+	if state.timeline.IsZero() {
+		state.timeline = now
+	}
+	state.timeline = state.timeline.Add(d)
+	if state.timeline.After(now) {
+		state.mhs5200.sleep(state.timeline.Sub(now))
+	} else if late := now.Sub(state.timeline); late >= SCRIPT_LATE_THRESHOLD {
+		state.logf("Running %v behind schedule", late.Round(time.Millisecond))
+	}
+}
+
+// parseCronField parses one field of a crontab schedule, a list of *, values,
+// ranges and steps such as */15 or 1-5/2, into a bit mask of the allowed values
+func parseCronField(s string, min uint, max uint, names []string) (uint64, error) {
+	value := func(v string) (uint, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return uint(i) + min, nil
+			}
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || uint(n) < min || uint(n) > max {
+			return 0, fmt.Errorf("%v is outside [%v, %v]", v, min, max)
+		}
+		return uint(n), nil
+	}
+	mask := uint64(0)
+	for _, part := range strings.Split(s, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 32)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("Invalid step in %v", part)
+			}
+			step = uint(n)
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			lo, err = value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = value(bounds[1])
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("Invalid range %v", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// parseCron parses the five fields of a crontab schedule, minute, hour, day of
+// month, month and day of week, or one of the @daily style shorthands
+func parseCron(s string) (*CRONSPEC, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(s)]; ok {
+		s = macro
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %v, expected 5 fields", s)
+	}
+	var spec CRONSPEC
+	var err error
+	spec.minute, err = parseCronField(fields[0], 0, 59, nil)
+	if err == nil {
+		spec.hour, err = parseCronField(fields[1], 0, 23, nil)
+	}
+	if err == nil {
+		spec.dom, err = parseCronField(fields[2], 1, 31, nil)
+	}
+	if err == nil {
+		spec.month, err = parseCronField(fields[3], 1, 12, cronMonthNames)
+	}
+	if err == nil {
+		spec.dow, err = parseCronField(fields[4], 0, 7, cronDayNames)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schedule %v, %v", s, err)
+	}
+	if spec.dow&(1<<7) != 0 { // 7 is sunday too
+		spec.dow |= 1
+	}
+	spec.anyDom = fields[2] == "*"
+	spec.anyDow = fields[4] == "*"
+	return &spec, nil
+}
+
+// dayMatches applies the crontab rule that a day matches either the day of month
+// or the day of week when both are restricted
+func (spec *CRONSPEC) dayMatches(t time.Time) bool {
+	dom := spec.dom&(1<<uint(t.Day())) != 0
+	dow := spec.dow&(1<<uint(t.Weekday())) != 0
+	if spec.anyDom || spec.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t the schedule is due
+func (spec *CRONSPEC) Next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(CRON_MAX_SEARCH_YEARS, 0, 0)
+	for t.Before(limit) {
+		if spec.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("schedule is never due")
+}
+
+// loadCrontab reads a crontab style file, one job per line made of a schedule and
+// the script to run. Blank lines and lines starting with # are ignored
+func loadCrontab(filename string) ([]CRONJOB, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jobs := make([]CRONJOB, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		nschedule := 5
+		if strings.HasPrefix(fields[0], "@") {
+			nschedule = 1
+		}
+		if len(fields) != nschedule+1 {
+			return nil, fmt.Errorf("%v:%v: expected a schedule and a script", filename, n)
+		}
+		when := strings.Join(fields[:nschedule], " ")
+		spec, err := parseCron(when)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filename, n, err)
+		}
+		jobs = append(jobs, CRONJOB{
+			spec:   *spec,
+			when:   when,
+			script: fields[nschedule],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%v has no jobs", filename)
+	}
+	return jobs, nil
+}
+
+// validateCrontab checks a crontab file and every script it runs, and shows when
+// each job runs next
+func validateCrontab(filename string, port string) error {
+	jobs, err := loadCrontab(filename)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for _, job := range jobs {
+		err = validateScript(job.script, port)
+		if err != nil {
+			goutils.Log.Print(err)
+			invalid++
+			continue
+		}
+		next, err := job.spec.Next(time.Now())
+		if err != nil {
+			goutils.Log.Printf("%v: %v", job.when, err)
+			invalid++
+			continue
+		}
+		fmt.Printf("%v: next run %v\n", job.script, next.Format(time.RFC1123))
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%v: %v of %v jobs are not valid", filename, invalid, len(jobs))
+	}
+	return nil
+}
+
+// cronDaemon runs the scripts of a crontab file on their schedules until it is
+// killed. A failing script is logged and does not stop the daemon. A job still
+// running when it is next due skips the runs it missed
+func cronDaemon(filename string, port string) error {
+	jobs, err := loadCrontab(filename)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range jobs {
+		jobs[i].next, err = jobs[i].spec.Next(now)
+		if err != nil {
+			return fmt.Errorf("%v: %v", jobs[i].when, err)
+		}
+		fmt.Printf("%v: Scheduled %v, next run %v\n", timestampString(), jobs[i].script, jobs[i].next.Format(time.RFC1123))
+	}
+	for {
+		job := &jobs[0]
+		for i := range jobs {
+			if jobs[i].next.Before(job.next) {
+				job = &jobs[i]
+			}
+		}
+		d := time.Until(job.next)
+		if d > 0 {
+			time.Sleep(d)
+		}
+		fmt.Printf("%v: Running %v\n", timestampString(), job.script)
+		start := time.Now()
+		err := playbackScript(job.script, port)
+		if err != nil {
+			goutils.Log.Printf("%v: %v", job.script, err)
+		}
+		fmt.Printf("%v: Finished %v in %v\n", timestampString(), job.script, time.Since(start).Round(time.Second))
+		next, err := job.spec.Next(job.next)
+		if err != nil {
+			return err
+		}
+		if now := time.Now(); next.Before(now) {
+			missed := 0
+			for next.Before(now) {
+				next, err = job.spec.Next(next)
+				if err != nil {
+					return err
+				}
+				missed++
+			}
+			fmt.Printf("%v: %v overran its schedule, skipped %v runs\n", timestampString(), job.script, missed)
+		}
+		job.next = next
+		fmt.Printf("%v: Next run of %v %v\n", timestampString(), job.script, job.next.Format(time.RFC1123))
+	}
+}
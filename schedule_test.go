@@ -0,0 +1,218 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// cronMask returns the bit mask of a cron field allowing values
+func cronMask(values ...uint) uint64 {
+	mask := uint64(0)
+	for _, v := range values {
+		mask |= 1 << v
+	}
+	return mask
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		s        string
+		min, max uint
+		names    []string
+		want     uint64
+	}{
+		{"*", 0, 59, nil, 1<<60 - 1},
+		{"*", 1, 12, nil, 1<<13 - 2},
+		{"5", 0, 59, nil, cronMask(5)},
+		{"1,3,5", 1, 31, nil, cronMask(1, 3, 5)},
+		{"10-12", 0, 23, nil, cronMask(10, 11, 12)},
+		{"*/15", 0, 59, nil, cronMask(0, 15, 30, 45)},
+		{"1-9/4", 0, 59, nil, cronMask(1, 5, 9)},
+		{"50/5", 0, 59, nil, cronMask(50, 55)},
+		{"1-2,20-21", 0, 23, nil, cronMask(1, 2, 20, 21)},
+		{"jan", 1, 12, cronMonthNames, cronMask(1)},
+		{"Jan-Mar", 1, 12, cronMonthNames, cronMask(1, 2, 3)},
+		{"dec", 1, 12, cronMonthNames, cronMask(12)},
+		{"sun", 0, 7, cronDayNames, cronMask(0)},
+		{"MON-fri", 0, 7, cronDayNames, cronMask(1, 2, 3, 4, 5)},
+		{"7", 0, 7, cronDayNames, cronMask(7)},
+	}
+	for _, test := range tests {
+		got, err := parseCronField(test.s, test.min, test.max, test.names)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q = %b, want %b", test.s, got, test.want)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	tests := []struct {
+		s        string
+		min, max uint
+	}{
+		{"60", 0, 59},
+		{"0", 1, 31},
+		{"-1", 0, 59},
+		{"5-1", 0, 59},
+		{"1-", 0, 59},
+		{"*/0", 0, 59},
+		{"*/x", 0, 59},
+		{"x", 0, 59},
+		{"", 0, 59},
+		{"1,,2", 0, 59},
+		{"foo", 1, 12},
+	}
+	for _, test := range tests {
+		if got, err := parseCronField(test.s, test.min, test.max, cronMonthNames); err == nil {
+			t.Errorf("%q = %b, want an error", test.s, got)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"* * * * *", "2026-10-18 12:30:00", "2026-10-18 12:31:00"},
+		{"30 10 * * *", "2026-10-18 10:30:00", "2026-10-19 10:30:00"},
+		{"30 10 * * *", "2026-10-18 10:29:59", "2026-10-18 10:30:00"},
+		{"*/15 * * * *", "2026-10-18 10:07:30", "2026-10-18 10:15:00"},
+		{"0 0 * * *", "2026-10-18 12:30:00", "2026-10-19 00:00:00"},
+		{"@hourly", "2026-10-18 23:59:00", "2026-10-19 00:00:00"},
+		{"@monthly", "2026-12-05 00:00:00", "2027-01-01 00:00:00"},
+		{"@yearly", "2026-10-18 00:00:00", "2027-01-01 00:00:00"},
+		// Saturday to Monday
+		{"30 9 * * mon-fri", "2026-10-24 12:00:00", "2026-10-26 09:30:00"},
+		// a restricted day of month with any day of week must match the day of month
+		{"0 0 1 * *", "2026-10-18 00:00:00", "2026-11-01 00:00:00"},
+		{"0 0 13 * *", "2026-10-18 00:00:00", "2026-11-13 00:00:00"},
+		// a restricted day of week with any day of month must match the day of week
+		{"0 0 * * fri", "2026-10-18 00:00:00", "2026-10-23 00:00:00"},
+		// with both restricted either one matching is enough, Friday 30th before the 1st
+		{"0 0 1 * 5", "2026-10-27 00:00:00", "2026-10-30 00:00:00"},
+		// and Sunday the 1st before the next Friday
+		{"0 0 1 * 5", "2026-10-31 00:00:00", "2026-11-01 00:00:00"},
+		{"0 12 1,15 * sat", "2026-10-18 00:00:00", "2026-10-24 12:00:00"},
+		// 7 and 0 are both Sunday
+		{"0 0 * * 7", "2026-10-19 00:00:00", "2026-10-25 00:00:00"},
+		{"0 0 * * 0", "2026-10-19 00:00:00", "2026-10-25 00:00:00"},
+		{"@weekly", "2026-10-19 00:00:00", "2026-10-25 00:00:00"},
+		{"0 0 * * 6-7", "2026-10-19 00:00:00", "2026-10-24 00:00:00"},
+		{"0 0 29 feb *", "2026-10-18 00:00:00", "2028-02-29 00:00:00"},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		got, err := spec.Next(at(test.from))
+		if err != nil {
+			t.Errorf("%q from %v: %v", test.spec, test.from, err)
+			continue
+		}
+		if want := at(test.want); !got.Equal(want) {
+			t.Errorf("%q from %v = %v, want %v", test.spec, test.from, got, want)
+		}
+	}
+}
+
+func TestCronNextNeverDue(t *testing.T) {
+	spec, err := parseCron("0 0 31 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := spec.Next(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("Next = %v, want an error", got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, s := range []string{"", "* * * *", "* * * * * *", "@often", "60 * * * *", "* 24 * * *", "* * 32 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCron(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+	}{
+		{"0", 0},
+		{"90", 90 * time.Second},
+		{"1.5", 1500 * time.Millisecond},
+		{" 10 ", 10 * time.Second},
+		{"1:30", 90 * time.Second},
+		{"0:00.25", 250 * time.Millisecond},
+		{"1:00:05", time.Hour + 5*time.Second},
+		{"01:02:03.5", time.Hour + 2*time.Minute + 3500*time.Millisecond},
+		{"25:00:00", 25 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"500ms", 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		got, err := parseOffset(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q = %v, want %v", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "-5", "-1m", "abc", "1:2:3:4", "a:30", "1:b", "-1:30", "1.5:30"} {
+		if got, err := parseOffset(s); err == nil {
+			t.Errorf("%q = %v, want an error", s, got)
+		}
+	}
+}
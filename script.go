@@ -39,41 +39,181 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/peterska/go-utils"
-	"io/ioutil"
 	"math"
+	"os"
+	"path"
+	"reflect"
+	"strings"
 	"time"
 )
 
 const (
 	defaultPollingIntervalSeconds = 60
+	SCRIPT_MAX_CALL_DEPTH         = 32
+	SCRIPT_MEASURE_INTERVAL       = 1.0 // seconds, the counter gate time
 )
 
 type CMDPARAMS struct {
-	Channel     *uint    `json:"channel,omitempty"`
-	Frequency   *float64 `json:"frequency,omitempty"`
-	Waveform    *string  `json:"waveform,omitempty"`
-	Amplitude   *float64 `json:"amplitude,omitempty"`
-	Phase       *float64 `json:"phase,omitempty"`
-	Duty        *float64 `json:"duty,omitempty"`
-	Offset      *float64 `json:"offset,omitempty"`
-	Attenuation *bool    `json:"attenuation,omitempty"`
-	Seconds     *uint    `json:"seconds,omitempty"`
-	Slot        *uint    `json:"slot,omitempty"`
-	Startf      *float64 `json:"startf,omitempty"`
-	Endf        *float64 `json:"endf,omitempty"`
-	Type        *string  `json:"type,omitempty"`
+	Channel     *uint       `json:"channel,omitempty"`
+	Frequency   *float64    `json:"frequency,omitempty"`
+	Waveform    *string     `json:"waveform,omitempty"`
+	Amplitude   *float64    `json:"amplitude,omitempty"`
+	Phase       *float64    `json:"phase,omitempty"`
+	Duty        *float64    `json:"duty,omitempty"`
+	Offset      *float64    `json:"offset,omitempty"`
+	Attenuation *bool       `json:"attenuation,omitempty"`
+	Seconds     *uint       `json:"seconds,omitempty"`
+	Slot        *uint       `json:"slot,omitempty"`
+	Startf      *float64    `json:"startf,omitempty"`
+	Endf        *float64    `json:"endf,omitempty"`
+	Type        *string     `json:"type,omitempty"`
+	Shape       *string     `json:"shape,omitempty"`
+	Order       *uint       `json:"order,omitempty"`
+	Harmonics   []HARMONIC  `json:"harmonics,omitempty"`
+	Pattern     *PATTERN    `json:"pattern,omitempty"`
+	File        *string     `json:"file,omitempty"`
+	Transforms  []TRANSFORM `json:"transforms,omitempty"`
+	Count       *uint       `json:"count,omitempty"`
+	Name        *string     `json:"name,omitempty"`
+	Param       *string     `json:"param,omitempty"`
+	Values      []float64   `json:"values,omitempty"`
+	Var         *string     `json:"var,omitempty"`
+	Value       *float64    `json:"value,omitempty"`
+	Samples     *uint       `json:"samples,omitempty"`
+	Interval    *float64    `json:"interval,omitempty"`
+	Condition   *float64    `json:"condition,omitempty"`
+	Expected    *float64    `json:"expected,omitempty"`
+	Tolerance   *float64    `json:"tolerance,omitempty"`
+	Percent     *float64    `json:"percent,omitempty"`
+	Ppm         *float64    `json:"ppm,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	From        *float64    `json:"from,omitempty"`
+	To          *float64    `json:"to,omitempty"`
+	Duration    *string     `json:"duration,omitempty"`
+	Rate        *float64    `json:"rate,omitempty"`
+	Step        *float64    `json:"step,omitempty"`
+	Dwell       *string     `json:"dwell,omitempty"`
+	Points      *uint       `json:"points,omitempty"`
+	Decade      *uint       `json:"decade,omitempty"`
+	Direction   *string     `json:"direction,omitempty"`
+	Measure     *string     `json:"measure,omitempty"`
+	Bits        *string     `json:"bits,omitempty"`
+	Mark        *float64    `json:"mark,omitempty"`
+	Space       *float64    `json:"space,omitempty"`
+	Text        *string     `json:"text,omitempty"`
+	Wpm         *float64    `json:"wpm,omitempty"`
+	Tone        *float64    `json:"tone,omitempty"`
+	Digits      *string     `json:"digits,omitempty"`
+	Gap         *string     `json:"gap,omitempty"`
+	Period      *string     `json:"period,omitempty"`
+	Cycles      *uint       `json:"cycles,omitempty"`
+	Window      *string     `json:"window,omitempty"`
+	Method      *string     `json:"method,omitempty"`
+	Accuracy    *string     `json:"accuracy,omitempty"`
+	Fatal       *bool       `json:"fatal,omitempty"`
 }
 
 type CMD struct {
-	Cmd  string      `json:"cmd,omitempty"`
-	Data []CMDPARAMS `json:"data,omitempty"`
+	Cmd   string          `json:"cmd,omitempty"`
+	Name  string          `json:"name,omitempty"`  // named steps are reported as test cases
+	At    string          `json:"at,omitempty"`    // offset from the start of the script the step runs at
+	Clock string          `json:"clock,omitempty"` // wall clock time the step runs at
+	Data  json.RawMessage `json:"data,omitempty"`  // []CMDPARAMS, decoded when the command runs so ${expr} can be expanded
+	Cmds  []CMD           `json:"cmds,omitempty"`  // body of repeat, foreach and if
+	Else  []CMD           `json:"else,omitempty"`  // run by if when the condition is false
 }
 
 type SCRIPT struct {
-	Port string `json:"port,omitempty"`
-	Cmds []CMD  `json:"cmds,omitempty"`
+	Port       string             `json:"port,omitempty"`
+	Compensate bool               `json:"compensate,omitempty"` // keep delays on schedule regardless of command latency
+	SafeState  *bool              `json:"safestate,omitempty"`  // false leaves the instrument as the script set it up
+	Profile    string             `json:"profile,omitempty"`    // limit profile, -profile overrides it
+	AutoRamp   string             `json:"autoramp,omitempty"`   // ramp the amplitude over this duration on on and off
+	Include    []string           `json:"include,omitempty"`    // scripts whose vars and subs are merged in
+	Vars       map[string]float64 `json:"vars,omitempty"`
+	Subs       map[string][]CMD   `json:"subs,omitempty"`
+	Cmds       []CMD              `json:"cmds,omitempty"`
+
+	included map[string]bool // subs merged in from included scripts
+}
+
+// SCRIPTPLAYER executes the commands of a script. inject holds the values of the
+// enclosing foreach loops, vars the script variables, depth the current
+// subroutine call depth and state the selected channel and slot. Progress is
+// checkpointed after every step so the script can be resumed
+type SCRIPTPLAYER struct {
+	mhs5200        *MHS5200A
+	state          *COMMANDSTATE
+	script         *SCRIPT
+	inject         map[string]float64
+	vars           map[string]float64
+	depth          int
+	name           string
+	start          time.Time
+	results        []SCRIPTRESULT
+	measured       []string
+	scriptfile     string
+	hash           string
+	steps          int               // steps completed
+	frames         []CHECKPOINTFRAME // position of the running step
+	resume         []CHECKPOINTFRAME // position to resume at, nil once resumed
+	checkpointFile string            // file progress is saved to, empty to not save it
+	assertName     string            // step name a named assert records its result under
+	stepLimit      int               // steps and loop iterations a run stops after, 0 for no limit
+	ticks          int               // steps and loop iterations run
+}
+
+// SCRIPTRESULT is the outcome of an assert or of a named step. Low and High are
+// the limits an assert checked Value against, Error marks the step that stopped
+// the script
+type SCRIPTRESULT struct {
+	Name       string
+	Assert     bool
+	Passed     bool
+	Error      bool
+	Value      float64
+	Low        float64
+	High       float64
+	Message    string
+	Configured string
+	Measured   []string
+	Time       time.Time
+	Duration   time.Duration
+}
+
+// SCRIPTFAILURE is returned by playbackScript when the script ran to completion,
+// or to a fatal assert, but one or more asserts failed
+type SCRIPTFAILURE struct {
+	Failed int
+	Total  int
+}
+
+func (e *SCRIPTFAILURE) Error() string {
+	return fmt.Sprintf("%v of %v assertions failed", e.Failed, e.Total)
+}
+
+// errFatalAssert stops the script at a failed fatal assert
+var errFatalAssert = fmt.Errorf("fatal assert failed")
+var errStepLimit = fmt.Errorf("step limit reached")
+
+// VARFLAGS collects the name=value script variable overrides given with -set
+type VARFLAGS []string
+
+func (v *VARFLAGS) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *VARFLAGS) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("expected name=value")
+	}
+	*v = append(*v, s)
+	return nil
 }
 
+var scriptVarOverrides VARFLAGS
+
 func (params *CMDPARAMS) convertToChannelVals(mhs5200 *MHS5200A) *CHANNELVALS {
 	v := CHANNELVALS{
 		Channel:     math.MaxUint32,
@@ -152,27 +292,54 @@ func (params *CMDPARAMS) convertToSweepVals(mhs5200 *MHS5200A) *SWEEPVALS {
 	return &v
 }
 
+// setDefault sets the numeric parameter with the json name to value if the
+// script did not set it. It returns false if there is no such parameter
+func (params *CMDPARAMS) setDefault(name string, value float64) bool {
+	v := reflect.ValueOf(params).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != name {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() != reflect.Ptr {
+			return false
+		}
+		switch f.Type().Elem().Kind() {
+		case reflect.Float64:
+			if f.IsNil() {
+				f.Set(reflect.ValueOf(&value))
+			}
+			return true
+		case reflect.Uint:
+			if f.IsNil() {
+				u := uint(math.Max(0, math.Round(value)))
+				f.Set(reflect.ValueOf(&u))
+			}
+			return true
+		}
+		return false
+	}
+	return false
+}
+
 func script(scriptfile string, port string) (*SCRIPT, error) {
 	if len(scriptfile) == 0 {
 		return nil, fmt.Errorf("Cannot find configuration file")
 	}
-	jsn, err := ioutil.ReadFile(scriptfile)
+	script, err := loadScript(scriptfile, false, nil)
 	if err != nil {
 		goutils.Log.Printf("%v", err)
 		return nil, err
 	}
-	script := SCRIPT{
-		Port: port,
-	}
-	err = json.Unmarshal(jsn, &script)
-	if err != nil {
-		goutils.Log.Printf("%v", err)
-		return nil, err
+	if len(script.Port) == 0 {
+		script.Port = port
 	}
 	if goutils.Loglevel() > 1 {
 		goutils.Log.Printf("Loaded config from %v, %+v", scriptfile, script)
 	}
-	return &script, nil
+	return script, nil
 }
 
 func timestampString() string {
@@ -184,163 +351,660 @@ func playbackScript(scriptfile string, port string) error {
 	if err != nil {
 		return err
 	}
-	if len(script.Port) == 0 {
+	if len(script.Port) == 0 && !dryRun {
 		goutils.Log.Printf("%v", fmt.Errorf("Port was not specified"))
 		return fmt.Errorf("Port was not specified")
 	}
-	mhs5200, err := NewMHS5200A(script.Port)
+	profile, err := selectProfile(script.Profile)
+	if err != nil {
+		return err
+	}
+	if len(script.AutoRamp) > 0 {
+		_, err = parseDuration(script.AutoRamp)
+		if err != nil {
+			return fmt.Errorf("autoramp: %v", err)
+		}
+	}
+	if scriptResume && dryRun {
+		return fmt.Errorf("-resume cannot be used with -dry-run")
+	}
+	mhs5200, err := openMHS5200A(script.Port)
 	if err != nil {
 		return err
 	}
 	defer mhs5200.Close()
-	for _, cmd := range script.Cmds {
-		switch cmd.Cmd {
-		case "config":
-			for _, data := range cmd.Data {
-				fmt.Printf("%v: Configuring channel %v\n", timestampString(), *data.Channel)
-				err = mhs5200.ApplyChannelConfig(data.convertToChannelVals(mhs5200))
-				if err != nil {
-					return err
-				}
-			}
+	// every return from here on leaves the instrument in the safe state, unless the
+	// script ran to its end and asked to be left as it set the instrument up
+	done := false
+	makeSafe := func() {
+		if done {
+			return
+		}
+		done = true
+		serr := mhs5200.ApplySafeState(safeState)
+		if serr != nil {
+			goutils.Log.Printf("%v", serr)
+		} else if len(safeState) > 0 {
+			fmt.Printf("%v: Applied the safe state, %v\n", timestampString(), strings.Join(safeState, ", "))
+		}
+	}
+	defer makeSafe()
+	if profile != nil {
+		mhs5200.SetProfile(profile)
+		fmt.Printf("%v: Enforcing the limits of profile %v\n", timestampString(), profile.Name)
+	}
+	if !dryRun { // the progress bar would garble the printed commands
+		mhs5200.SetUploadProgress(uploadProgressBar)
+	}
+	player := newScriptPlayer(mhs5200, script, scriptfile)
+	if !dryRun {
+		player.checkpointFile = checkpointFilename(scriptfile)
+	}
+	if scriptResume {
+		err = player.loadCheckpoint()
+		if err != nil {
+			return err
+		}
+	} else if len(player.checkpointFile) > 0 {
+		os.Remove(player.checkpointFile) // a new run starts over
+	}
+	err = player.play()
+	player.finishCheckpoint(err)
+	if err != nil || script.SafeState == nil || *script.SafeState {
+		makeSafe()
+	} else {
+		done = true
+	}
+	if dryRun {
+		commands, elapsed := mhs5200.DryRunStatistics()
+		fmt.Printf("%v: Dry run sent %v commands, estimated runtime %v\n", timestampString(), commands, elapsed.Round(time.Second))
+	}
+	rerr := player.writeReports()
+	if rerr != nil {
+		goutils.Log.Printf("%v", rerr)
+	}
+	return player.summary(err)
+}
 
-		case "showconfig":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Channel != nil {
-						err = mhs5200.ShowChannelConfig(*data.Channel)
-					} else {
-						err = mhs5200.ShowConfig()
-					}
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				err = mhs5200.ShowConfig()
-				if err != nil {
-					return err
-				}
-			}
+func newScriptPlayer(mhs5200 *MHS5200A, script *SCRIPT, scriptfile string) *SCRIPTPLAYER {
+	player := &SCRIPTPLAYER{
+		mhs5200:    mhs5200,
+		script:     script,
+		inject:     make(map[string]float64),
+		name:       strings.TrimSuffix(path.Base(scriptfile), path.Ext(scriptfile)),
+		start:      mhs5200.now(),
+		scriptfile: scriptfile,
+		hash:       scriptHash(script),
+	}
+	player.state = &COMMANDSTATE{
+		mhs5200:    mhs5200,
+		player:     player,
+		compensate: script.Compensate,
+		timeline:   player.start,
+		autoRamp:   autoRamp,
+	}
+	if len(script.AutoRamp) > 0 {
+		// an invalid duration is reported by playbackScript and the linter
+		if d, err := parseDuration(script.AutoRamp); err == nil {
+			player.state.autoRamp = d
+		}
+	}
+	return player
+}
 
-		case "delay":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Seconds != nil {
-						fmt.Printf("%v: Sleeping %v seconds\n", timestampString(), *data.Seconds)
-						time.Sleep(time.Second * time.Duration(*data.Seconds))
-					}
-				}
-			} else {
-				time.Sleep(time.Second * 1)
-			}
+// play runs the whole script, recording an error that stops it as a result
+func (player *SCRIPTPLAYER) play() error {
+	if player.vars == nil { // resumed scripts carry on with their checkpointed vars
+		err := player.initVars()
+		if err != nil {
+			return err
+		}
+	}
+	err := player.run(player.script.Cmds)
+	if err != nil && err != errFatalAssert && (len(player.results) == 0 || !player.results[len(player.results)-1].Error) {
+		player.results = append(player.results, SCRIPTRESULT{
+			Name:    "script",
+			Error:   true,
+			Message: err.Error(),
+			Time:    player.mhs5200.now(),
+		})
+	}
+	return err
+}
 
-		case "measure":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Type != nil {
-						err = mhs5200.Measure(*data.Type)
-					}
-				}
-			}
-		case "sleep":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Seconds != nil {
-						fmt.Printf("%v: Sleeping %v seconds\n", timestampString(), *data.Seconds)
-						time.Sleep(time.Second * time.Duration(*data.Seconds))
-					}
-				}
-			} else {
-				time.Sleep(time.Second * 1)
+// summary prints the assert results and turns failed asserts into a SCRIPTFAILURE
+func (player *SCRIPTPLAYER) summary(err error) error {
+	total, failed := 0, 0
+	for _, r := range player.results {
+		if r.Assert {
+			total++
+			if !r.Passed {
+				failed++
 			}
+		}
+	}
+	if total > 0 {
+		fmt.Printf("%v: %v of %v assertions passed\n", timestampString(), total-failed, total)
+	}
+	if err != nil && err != errFatalAssert {
+		return err
+	}
+	if failed > 0 {
+		return &SCRIPTFAILURE{
+			Failed: failed,
+			Total:  total,
+		}
+	}
+	return nil
+}
 
-		case "on":
-			fmt.Printf("%v: Output on\n", timestampString())
-			err = mhs5200.SetOnOff(true)
+// initVars sets up the script variables, applying the -set overrides on top of
+// the vars section of the script. Overrides may be expressions of script variables
+func (player *SCRIPTPLAYER) initVars() error {
+	player.vars = make(map[string]float64)
+	for name, value := range player.script.Vars {
+		if !validVariableName(name) {
+			return fmt.Errorf("Invalid variable name %v", name)
+		}
+		player.vars[name] = value
+	}
+	for _, override := range scriptVarOverrides {
+		kv := strings.SplitN(override, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if !validVariableName(name) {
+			return fmt.Errorf("Invalid variable name %v", name)
+		}
+		value, err := evalExpression(kv[1], player.vars)
+		if err != nil {
+			return err
+		}
+		player.vars[name] = value
+	}
+	if goutils.Loglevel() > 0 {
+		goutils.Log.Printf("%v: %+v", goutils.Funcname(), player.vars)
+	}
+	return nil
+}
+
+// expand replaces ${expr} expressions in decoded json. A string holding nothing
+// but an expression becomes a number, otherwise the values are substituted as text
+func (player *SCRIPTPLAYER) expand(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		if strings.HasPrefix(t, "${") && strings.Index(t, "}") == len(t)-1 {
+			return evalExpression(t[2:len(t)-1], player.vars)
+		}
+		return expandExpressions(t, player.vars)
+	case []interface{}:
+		for i := range t {
+			e, err := player.expand(t[i])
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-		case "off":
-			fmt.Printf("%v: Output off\n", timestampString())
-			err = mhs5200.SetOnOff(false)
+			t[i] = e
+		}
+	case map[string]interface{}:
+		for k := range t {
+			e, err := player.expand(t[k])
 			if err != nil {
-				return err
+				return nil, err
 			}
+			t[k] = e
+		}
+	}
+	return v, nil
+}
 
-		case "save":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Slot != nil {
-						fmt.Printf("%v: Saving to slot %v\n", timestampString(), *data.Slot)
-						err = mhs5200.Save(*data.Slot)
-					} else {
-						err = mhs5200.Save(0)
-					}
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				err = mhs5200.Save(0)
-				if err != nil {
-					return err
-				}
-			}
+// params decodes the data of a command, expanding expressions using the current
+// variables and filling in the values of the enclosing foreach loops
+func (player *SCRIPTPLAYER) params(cmd CMD) ([]CMDPARAMS, error) {
+	if len(cmd.Data) == 0 {
+		return nil, nil
+	}
+	var raw interface{}
+	err := json.Unmarshal(cmd.Data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Cmd, err)
+	}
+	raw, err = player.expand(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Cmd, err)
+	}
+	jsn, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var params []CMDPARAMS
+	err = json.Unmarshal(jsn, &params)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Cmd, err)
+	}
+	return params, nil
+}
 
-		case "load":
-			if cmd.Data != nil {
-				for _, data := range cmd.Data {
-					if data.Slot != nil {
-						fmt.Printf("%v: Loading from slot %v\n", timestampString(), *data.Slot)
-						err = mhs5200.Load(*data.Slot)
-					} else {
-						err = mhs5200.Load(0)
-					}
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				err = mhs5200.Load(0)
-				if err != nil {
-					return err
-				}
-			}
+// tick counts a step or loop iteration, and stops a run that has a step limit when
+// it is reached
+func (player *SCRIPTPLAYER) tick() error {
+	player.ticks++
+	if player.stepLimit > 0 && player.ticks > player.stepLimit {
+		return errStepLimit
+	}
+	return nil
+}
 
-		case "showsweep":
-			err = mhs5200.ShowSweepConfig()
+// run executes a list of commands in order, stopping at the first error
+func (player *SCRIPTPLAYER) run(cmds []CMD) error {
+	level := len(player.frames)
+	player.frames = append(player.frames, CHECKPOINTFRAME{})
+	defer func() {
+		player.frames = player.frames[:level]
+	}()
+	start := 0
+	if resume := player.resumeFrame(level); resume != nil {
+		start = resume.Step
+		if level == len(player.resume)-1 {
+			player.resume = nil // carry on after the last completed step
+		}
+	}
+	for i := start; i < len(cmds); i++ {
+		cmd := cmds[i]
+		player.frames[level] = CHECKPOINTFRAME{Step: i}
+		if err := player.tick(); err != nil {
+			return err
+		}
+		if player.resume == nil { // a step being resumed into already waited for its time
+			err := player.schedule(cmd)
 			if err != nil {
 				return err
 			}
+		}
+		var err error
+		if len(cmd.Name) > 0 {
+			err = player.runNamed(cmd)
+		} else {
+			err = player.runCmd(cmd)
+		}
+		if err != nil {
+			return err
+		}
+		if !cmd.container() {
+			player.frames[level].Step = i + 1
+			player.saveCheckpoint()
+		}
+	}
+	return nil
+}
+
+// runNamed executes a named step and records its timing, configuration, the
+// measurements taken and its outcome as a result
+func (player *SCRIPTPLAYER) runNamed(cmd CMD) error {
+	name, err := expandExpressions(cmd.Name, player.vars)
+	if err != nil {
+		name = cmd.Name
+	}
+	if cmd.Cmd == "assert" { // the assert records its own result, under the step name
+		player.assertName = name
+		defer func() { player.assertName = "" }()
+		return player.runCmd(cmd)
+	}
+	r := SCRIPTRESULT{
+		Name:       name,
+		Configured: string(cmd.Data),
+		Time:       player.mhs5200.now(),
+	}
+	params, err := player.params(cmd)
+	if err == nil && params != nil {
+		player.injectParams(params)
+		jsn, err := json.Marshal(params)
+		if err == nil {
+			r.Configured = string(jsn)
+		}
+	}
+	measured := len(player.measured)
+	results := len(player.results)
+	err = player.runCmd(cmd)
+	r.Duration = player.mhs5200.now().Sub(r.Time)
+	r.Measured = append(r.Measured, player.measured[measured:]...)
+	r.Passed = err == nil
+	if err != nil {
+		r.Error = err != errFatalAssert
+		r.Message = err.Error()
+	}
+	for _, inner := range player.results[results:] { // a step fails with the asserts it ran
+		if r.Passed && !inner.Passed {
+			r.Passed = false
+			r.Message = fmt.Sprintf("%v failed", inner.Name)
+		}
+	}
+	player.results = append(player.results, r)
+	return err
+}
 
-		case "configsweep":
-			// sweeps are only valid on channel 1
-			for _, data := range cmd.Data {
-				fmt.Printf("%v: Configuring sweep\n", timestampString())
-				err = mhs5200.SetSweep(data.convertToSweepVals(mhs5200))
-				if err != nil {
-					return err
-				}
+// injectParams fills the values of the enclosing foreach loops into the command
+// parameters where the script did not set them
+func (player *SCRIPTPLAYER) injectParams(params []CMDPARAMS) {
+	for i := range params {
+		for name, value := range player.inject {
+			params[i].setDefault(name, value)
+		}
+	}
+}
+
+// set assigns the value of a set command to the variable name
+func (player *SCRIPTPLAYER) set(params []CMDPARAMS) error {
+	for _, data := range params {
+		if data.Name == nil || data.Value == nil {
+			return fmt.Errorf("set needs a name and a value")
+		}
+		if !validVariableName(*data.Name) {
+			return fmt.Errorf("Invalid variable name %v", *data.Name)
+		}
+		player.vars[*data.Name] = *data.Value
+		fmt.Printf("%v: Setting %v = %v\n", timestampString(), *data.Name, *data.Value)
+	}
+	return nil
+}
+
+// repeat runs the body of a repeat command count times, for a number of
+// seconds, or whichever finishes first if both are given. The iteration number,
+// starting at 1, is stored in the variable var if given
+func (player *SCRIPTPLAYER) repeat(params []CMDPARAMS, cmd CMD) error {
+	if len(params) == 0 || (params[0].Count == nil && params[0].Seconds == nil) {
+		return fmt.Errorf("repeat needs a count or seconds")
+	}
+	data := params[0]
+	count := uint(0)
+	if data.Count != nil {
+		count = *data.Count
+	}
+	if count == 0 && data.Seconds == nil {
+		return fmt.Errorf("repeat count 0 would never end, give seconds to repeat for a time")
+	}
+	level := len(player.frames) - 1
+	first := uint(1)
+	started := player.mhs5200.now()
+	if resume := player.resumeFrame(level); resume != nil && resume.Iteration > 0 {
+		first = resume.Iteration
+		if !resume.Started.IsZero() {
+			started = resume.Started
+		}
+	}
+	var deadline time.Time
+	if data.Seconds != nil {
+		deadline = started.Add(time.Second * time.Duration(*data.Seconds))
+	}
+	for n := first; count == 0 || n <= count; n++ {
+		now := player.mhs5200.now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			break
+		}
+		if count > 0 {
+			fmt.Printf("%v: Repeat %v/%v\n", timestampString(), n, count)
+		} else {
+			fmt.Printf("%v: Repeat %v, %v left\n", timestampString(), n, deadline.Sub(now).Round(time.Second))
+		}
+		if data.Var != nil {
+			player.vars[*data.Var] = float64(n)
+		}
+		player.frames[level].Iteration = n
+		player.frames[level].Started = started
+		if err := player.tick(); err != nil {
+			return err
+		}
+		err := player.run(cmd.Cmds)
+		if err != nil {
+			return err
+		}
+		if player.mhs5200.sim != nil && !player.mhs5200.now().After(now) {
+			// a body that takes no simulated time would never reach the deadline
+			player.mhs5200.sleep(time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// foreach runs the body of a foreach command once for every value, filling the
+// value into the named parameter of the commands in the body and storing it in
+// the variable var
+func (player *SCRIPTPLAYER) foreach(params []CMDPARAMS, cmd CMD) error {
+	if len(params) == 0 || (params[0].Param == nil && params[0].Var == nil) || len(params[0].Values) == 0 {
+		return fmt.Errorf("foreach needs a param or var and a list of values")
+	}
+	data := params[0]
+	name := ""
+	if data.Param != nil {
+		name = *data.Param
+		var probe CMDPARAMS
+		if !probe.setDefault(name, 0) {
+			return fmt.Errorf("foreach cannot iterate over %v", name)
+		}
+		prev, nested := player.inject[name]
+		defer func() {
+			if nested {
+				player.inject[name] = prev
+			} else {
+				delete(player.inject, name)
 			}
+		}()
+	}
+	if data.Var != nil {
+		if !validVariableName(*data.Var) {
+			return fmt.Errorf("Invalid variable name %v", *data.Var)
+		}
+		if len(name) == 0 {
+			name = *data.Var
+		}
+	}
+	level := len(player.frames) - 1
+	first := 0
+	if resume := player.resumeFrame(level); resume != nil && resume.Iteration > 0 {
+		first = int(resume.Iteration) - 1
+	}
+	for n := first; n < len(data.Values); n++ {
+		value := data.Values[n]
+		fmt.Printf("%v: Foreach %v = %v (%v/%v)\n", timestampString(), name, value, n+1, len(data.Values))
+		if data.Param != nil {
+			player.inject[*data.Param] = value
+		}
+		if data.Var != nil {
+			player.vars[*data.Var] = value
+		}
+		player.frames[level].Iteration = uint(n + 1)
+		err := player.run(cmd.Cmds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		case "sweepon":
-			fmt.Printf("%v: Sweep on\n", timestampString())
-			err = mhs5200.SetSweepState(true)
-			if err != nil {
-				return err
+// measure takes an averaged counter measurement and stores the mean in the
+// variable var
+func (player *SCRIPTPLAYER) measure(data CMDPARAMS) error {
+	typ := "frequency"
+	if data.Type != nil {
+		typ = *data.Type
+	}
+	samples := uint(1)
+	if data.Samples != nil {
+		samples = *data.Samples
+	}
+	interval := SCRIPT_MEASURE_INTERVAL
+	if data.Interval != nil {
+		interval = *data.Interval
+	}
+	if !validVariableName(*data.Var) {
+		return fmt.Errorf("Invalid variable name %v", *data.Var)
+	}
+	m, err := player.mhs5200.MeasureAverage(typ, samples, time.Duration(interval*float64(time.Second)))
+	if err != nil {
+		return err
+	}
+	player.vars[*data.Var] = m.Mean
+	player.measured = append(player.measured, fmt.Sprintf("%v=%v", *data.Var, m.Mean))
+	fmt.Printf("%v: Measured %v = %v (%v samples, min %v, max %v, std dev %v)\n", timestampString(), *data.Var,
+		player.mhs5200.MeasurementString(m.Mean), m.Samples,
+		player.mhs5200.MeasurementString(m.Min), player.mhs5200.MeasurementString(m.Max), player.mhs5200.MeasurementString(m.StdDev))
+	return nil
+}
+
+// assert checks a condition, or a value against an expected value with a
+// tolerance in absolute terms, percent or ppm, and/or against min and max limits.
+// Failures are recorded and the script carries on unless the assert is fatal
+func (player *SCRIPTPLAYER) assert(data CMDPARAMS) error {
+	r := SCRIPTRESULT{
+		Name:   fmt.Sprintf("assert %v", len(player.results)+1),
+		Assert: true,
+		Low:    math.Inf(-1),
+		High:   math.Inf(1),
+		Time:   player.mhs5200.now(),
+	}
+	if data.Name != nil {
+		r.Name = *data.Name
+	} else if len(player.assertName) > 0 {
+		r.Name = player.assertName
+	}
+	switch {
+	case data.Condition != nil:
+		r.Value = *data.Condition
+		r.Passed = r.Value != 0
+		if !r.Passed {
+			r.Message = "condition is false"
+		}
+
+	case data.Value != nil:
+		if data.Expected == nil && data.Min == nil && data.Max == nil {
+			return fmt.Errorf("assert %v needs an expected value, min or max", r.Name)
+		}
+		r.Value = *data.Value
+		if data.Expected != nil {
+			tolerance := 0.0
+			switch {
+			case data.Tolerance != nil:
+				tolerance = *data.Tolerance
+			case data.Percent != nil:
+				tolerance = math.Abs(*data.Expected) * *data.Percent / 100.0
+			case data.Ppm != nil:
+				tolerance = math.Abs(*data.Expected) * *data.Ppm / 1.0e6
 			}
+			r.Low = *data.Expected - tolerance
+			r.High = *data.Expected + tolerance
+		}
+		if data.Min != nil {
+			r.Low = math.Max(r.Low, *data.Min)
+		}
+		if data.Max != nil {
+			r.High = math.Min(r.High, *data.Max)
+		}
+		r.Measured = []string{fmt.Sprintf("%v", r.Value)}
+		r.Passed = r.Value >= r.Low && r.Value <= r.High
+		if !r.Passed {
+			r.Message = fmt.Sprintf("%v is outside [%v, %v]", r.Value, r.Low, r.High)
+		}
+
+	default:
+		return fmt.Errorf("assert %v needs a condition or a value", r.Name)
+	}
+	r.Duration = player.mhs5200.now().Sub(r.Time)
+	player.results = append(player.results, r)
+	if r.Passed {
+		fmt.Printf("%v: PASS %v\n", timestampString(), r.Name)
+	} else {
+		fmt.Printf("%v: FAIL %v, %v\n", timestampString(), r.Name, r.Message)
+		if data.Fatal != nil && *data.Fatal {
+			fmt.Printf("%v: Stopping at fatal assert %v\n", timestampString(), r.Name)
+			return errFatalAssert
+		}
+	}
+	return nil
+}
 
-		case "sweepoff":
-			fmt.Printf("%v: Sweep off\n", timestampString())
-			err = mhs5200.SetSweepState(false)
+// ifelse runs the body of an if command when its condition is non zero,
+// otherwise its else body
+func (player *SCRIPTPLAYER) ifelse(params []CMDPARAMS, cmd CMD) error {
+	if len(params) == 0 || params[0].Condition == nil {
+		return fmt.Errorf("if needs a condition")
+	}
+	// the branch is checkpointed, a resumed script carries on in the branch it was in
+	// even if the variables the condition uses were changed by it
+	level := len(player.frames) - 1
+	branch := uint(2)
+	if resume := player.resumeFrame(level); resume != nil && resume.Iteration > 0 {
+		branch = resume.Iteration
+	} else if *params[0].Condition != 0 {
+		branch = 1
+	}
+	player.frames[level].Iteration = branch
+	if branch == 1 {
+		return player.run(cmd.Cmds)
+	}
+	return player.run(cmd.Else)
+}
+
+// call runs a named subroutine from the subs section of the script
+func (player *SCRIPTPLAYER) call(params []CMDPARAMS) error {
+	if len(params) == 0 || params[0].Name == nil {
+		return fmt.Errorf("call needs a name")
+	}
+	name := *params[0].Name
+	sub, ok := player.script.Subs[name]
+	if !ok {
+		return fmt.Errorf("Unknown subroutine %v", name)
+	}
+	if player.depth >= SCRIPT_MAX_CALL_DEPTH {
+		return fmt.Errorf("Subroutine calls nested deeper than %v, calling %v", SCRIPT_MAX_CALL_DEPTH, name)
+	}
+	fmt.Printf("%v: Calling %v\n", timestampString(), name)
+	player.depth++
+	defer func() {
+		player.depth--
+	}()
+	return player.run(sub)
+}
+
+// runCmd executes a single script command, flow control here and everything
+// else through the command registry shared with the command line
+func (player *SCRIPTPLAYER) runCmd(cmd CMD) error {
+	params, err := player.params(cmd)
+	if err != nil {
+		return err
+	}
+	switch cmd.Cmd {
+	case "repeat":
+		return player.repeat(params, cmd)
+	case "foreach":
+		return player.foreach(params, cmd)
+	case "call":
+		return player.call(params)
+	case "set":
+		return player.set(params)
+	case "if":
+		return player.ifelse(params, cmd)
+	case "assert":
+		for _, data := range params {
+			err = player.assert(data)
 			if err != nil {
 				return err
 			}
-
-		default:
-			return fmt.Errorf("Unknown command %s", cmd.Cmd)
+		}
+		return nil
+	}
+	c := findCommand(cmd.Cmd)
+	if c == nil || c.CommandOnly {
+		return fmt.Errorf("Unknown command %s", cmd.Cmd)
+	}
+	if params == nil {
+		params = []CMDPARAMS{{}}
+	}
+	player.injectParams(params)
+	for i := range params {
+		err = c.checkRequired(&params[i])
+		if err != nil {
+			return err
+		}
+		err = c.Run(player.state, &params[i])
+		if err != nil {
+			return err
 		}
 	}
 	return nil
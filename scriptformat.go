@@ -0,0 +1,205 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// scriptJSON reads a script file and returns it as json. Files ending in .yaml,
+// .yml or .toml are converted, anything else is taken to be json
+func scriptJSON(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		err = yaml.Unmarshal(data, &v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		return json.Marshal(v)
+
+	case ".toml":
+		var v map[string]interface{}
+		_, err = toml.Decode(string(data), &v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		return json.Marshal(v)
+	}
+	return data, nil
+}
+
+// decodeScript reads a single script file, strict rejects unknown fields
+func decodeScript(filename string, strict bool) (*SCRIPT, error) {
+	jsn, err := scriptJSON(filename)
+	if err != nil {
+		return nil, err
+	}
+	var script SCRIPT
+	decoder := json.NewDecoder(strings.NewReader(string(jsn)))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(&script)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return &script, nil
+}
+
+// merge adds the variables and subroutines of an included script that the
+// including script does not define itself
+func (script *SCRIPT) merge(included *SCRIPT) {
+	for name, value := range included.Vars {
+		if _, ok := script.Vars[name]; !ok {
+			if script.Vars == nil {
+				script.Vars = make(map[string]float64)
+			}
+			script.Vars[name] = value
+		}
+	}
+	for name, sub := range included.Subs {
+		if _, ok := script.Subs[name]; !ok {
+			if script.Subs == nil {
+				script.Subs = make(map[string][]CMD)
+			}
+			script.Subs[name] = sub
+			if script.included == nil {
+				script.included = make(map[string]bool)
+			}
+			script.included[name] = true
+		}
+	}
+}
+
+// loadScript reads a script and resolves its includes. Scripts listed in include
+// contribute their variables and subroutines, an include command is replaced by
+// the commands of the included script. Included files are relative to the
+// directory of the script including them
+func loadScript(filename string, strict bool, stack []string) (*SCRIPT, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, fmt.Errorf("%v is included recursively", filename)
+		}
+	}
+	stack = append(stack, abs)
+	script, err := decodeScript(filename, strict)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	for _, inc := range script.Include {
+		included, err := loadScript(includePath(dir, inc), strict, stack)
+		if err != nil {
+			return nil, err
+		}
+		script.merge(included)
+	}
+	script.Include = nil
+	script.Cmds, err = script.inlineIncludes(script.Cmds, dir, strict, stack)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(script.Subs))
+	for name := range script.Subs {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		script.Subs[name], err = script.inlineIncludes(script.Subs[name], dir, strict, stack)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return script, nil
+}
+
+func includePath(dir string, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
+
+// inlineIncludes replaces include commands with the commands of the included scripts
+func (script *SCRIPT) inlineIncludes(cmds []CMD, dir string, strict bool, stack []string) ([]CMD, error) {
+	var out []CMD
+	for _, cmd := range cmds {
+		if cmd.Cmd != "include" {
+			var err error
+			cmd.Cmds, err = script.inlineIncludes(cmd.Cmds, dir, strict, stack)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Else, err = script.inlineIncludes(cmd.Else, dir, strict, stack)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cmd)
+			continue
+		}
+		var params []CMDPARAMS
+		err := json.Unmarshal(cmd.Data, &params)
+		if err != nil {
+			return nil, fmt.Errorf("include: %v", err)
+		}
+		for _, data := range params {
+			if data.File == nil {
+				return nil, fmt.Errorf("include needs a file")
+			}
+			included, err := loadScript(includePath(dir, *data.File), strict, stack)
+			if err != nil {
+				return nil, err
+			}
+			script.merge(included)
+			out = append(out, included.Cmds...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,208 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SIMULATOR_BAUD            = 57600
+	SIMULATOR_COMMAND_LATENCY = 10 * time.Millisecond // estimated processing time of a command by the instrument
+	SIMULATOR_SERIAL          = "DRY0"
+)
+
+var dryRun = false // print device commands instead of sending them, set by -dry-run
+
+// SIMULATOR stands in for the serial port in dry run mode and when validating
+// scripts. It answers commands the way the instrument does, remembers settings so
+// reads return what was last written, optionally prints every command, and keeps a
+// virtual clock which commands and sleeps advance instead of taking real time
+type SIMULATOR struct {
+	state    map[string]string
+	partial  []byte // command bytes written without a terminating newline yet
+	response []byte
+	print    bool
+	commands int
+	elapsed  time.Duration
+	start    time.Time
+}
+
+func newSimulator(print bool) *SIMULATOR {
+	return &SIMULATOR{
+		state: map[string]string{
+			"1w": "0", "2w": "0",
+			"1f": "100000", "2f": "100000",
+			"1a": "500", "2a": "500",
+			"1d": "500", "2d": "500",
+			"1o": "120", "2o": "120",
+			"1p": "0", "2p": "0",
+			"1y": "1", "2y": "1",
+			"3f": "100", "4f": "10000", "1t": "10", "7b": "0", "8b": "0",
+		},
+		print: print,
+		start: time.Now(),
+	}
+}
+
+// answer returns the instrument's response to a single command and updates the
+// simulated settings
+func (sim *SIMULATOR) answer(cmd string) string {
+	switch {
+	case cmd == ":r0c":
+		return ":r0c5225A"
+	case cmd == ":r1c":
+		return ":r1c0000V0304"
+	case cmd == ":r2c":
+		return ":r2c00000000" + SIMULATOR_SERIAL
+	case cmd == ":r0e":
+		// the counter measures an external signal, echo channel 1's frequency in Hz
+		f, _ := strconv.ParseUint(sim.state["1f"], 10, 64)
+		return fmt.Sprintf(":r0e%d", f/100)
+	case strings.HasPrefix(cmd, ":r"):
+		v, ok := sim.state[cmd[2:]]
+		if !ok {
+			v = "0"
+		}
+		return cmd + v
+	case strings.HasPrefix(cmd, ":s") && len(cmd) >= 4:
+		sim.state[cmd[2:4]] = cmd[4:]
+	}
+	return "ok"
+}
+
+func (sim *SIMULATOR) Write(p []byte) (int, error) {
+	sim.partial = append(sim.partial, p...)
+	for {
+		i := strings.IndexByte(string(sim.partial), '\n')
+		if i < 0 {
+			break
+		}
+		cmd := string(sim.partial[:i])
+		sim.partial = sim.partial[i+1:]
+		sim.commands++
+		sim.elapsed += time.Duration(len(cmd)+1)*10*time.Second/SIMULATOR_BAUD + SIMULATOR_COMMAND_LATENCY
+		if sim.print {
+			if len(cmd) > 48 {
+				fmt.Printf("    %v... (%v bytes)\n", cmd[:48], len(cmd))
+			} else {
+				fmt.Printf("    %v\n", cmd)
+			}
+		}
+		sim.response = append(sim.response, []byte(sim.answer(cmd)+"\n")...)
+	}
+	return len(p), nil
+}
+
+// Read returns the pending responses, io.EOF like a serial read timeout when there are none
+func (sim *SIMULATOR) Read(p []byte) (int, error) {
+	if len(sim.response) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, sim.response)
+	sim.response = sim.response[n:]
+	return n, nil
+}
+
+func (sim *SIMULATOR) Flush() error {
+	sim.response = nil
+	return nil
+}
+
+func (sim *SIMULATOR) Close() error {
+	return nil
+}
+
+// NewSimulatedMHS5200A returns an instrument connected to a SIMULATOR, printing
+// every command sent if print is set
+func NewSimulatedMHS5200A(print bool) *MHS5200A {
+	sim := newSimulator(print)
+	mhs5200 := &MHS5200A{
+		stream: sim,
+		sim:    sim,
+		port:   "dry run",
+		quit:   make(chan struct{}),
+	}
+	mhs5200.wg.Add(1)
+	go mhs5200.mhs5200()
+	return mhs5200
+}
+
+// openMHS5200A connects to the instrument on port, or to a printing SIMULATOR in dry run mode
+func openMHS5200A(port string) (*MHS5200A, error) {
+	var mhs5200 *MHS5200A
+	if dryRun {
+		mhs5200 = NewSimulatedMHS5200A(true)
+	} else {
+		var err error
+		mhs5200, err = NewMHS5200A(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	trackDevice(mhs5200)
+	return mhs5200, nil
+}
+
+// sleep waits for d, or advances the virtual clock when simulated
+func (mhs5200 *MHS5200A) sleep(d time.Duration) {
+	if mhs5200.sim != nil {
+		mhs5200.sim.elapsed += d
+		return
+	}
+	time.Sleep(d)
+}
+
+// now returns the current time, or the virtual time when simulated
+func (mhs5200 *MHS5200A) now() time.Time {
+	if mhs5200.sim != nil {
+		return mhs5200.sim.start.Add(mhs5200.sim.elapsed)
+	}
+	return time.Now()
+}
+
+// DryRunStatistics returns the number of commands sent to the simulator and the
+// estimated time the instrument would have taken
+func (mhs5200 *MHS5200A) DryRunStatistics() (int, time.Duration) {
+	if mhs5200.sim == nil {
+		return 0, 0
+	}
+	return mhs5200.sim.commands, mhs5200.sim.elapsed
+}
@@ -0,0 +1,317 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/peterska/go-utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Arbitrary waveform slot registry
+*
+* The MHS-5200A firmware has no command to read back the contents of the arbitrary
+* waveform slots, so every waveform we upload is recorded in a local registry file,
+* keyed by the serial number of the unit. This lets us list and dump what lives in
+* each slot of every bench unit.
+*
+ */
+
+// slotRegistryFilename is the registry file used, empty selects the default location
+var slotRegistryFilename = ""
+
+type ARBSLOT struct {
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name,omitempty"` // library waveform name, set when the slot is managed by the slot allocator
+	Source   string    `json:"source,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+	Used     time.Time `json:"used,omitempty"`
+	Samples  []int     `json:"samples,omitempty"`
+}
+
+type ARBUNIT struct {
+	Slots    map[uint]*ARBSLOT `json:"slots"`
+	Reserved []uint            `json:"reserved,omitempty"` // slots the slot allocator must never overwrite
+	Free     []uint            `json:"free,omitempty"`     // slots of unknown contents the slot allocator may fill
+}
+
+type SLOTREGISTRY struct {
+	filename string
+	Units    map[string]*ARBUNIT `json:"units"`
+}
+
+func defaultSlotRegistryFilename() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mhs5200a", "slots.json"), nil
+}
+
+func arbitraryWaveformHash(samples []int) string {
+	h := sha256.New()
+	for _, v := range samples {
+		fmt.Fprintf(h, "%d,", v)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func loadSlotRegistry(filename string) (*SLOTREGISTRY, error) {
+	if len(filename) == 0 {
+		var err error
+		filename, err = defaultSlotRegistryFilename()
+		if err != nil {
+			return nil, err
+		}
+	}
+	registry := SLOTREGISTRY{
+		filename: filename,
+		Units:    make(map[string]*ARBUNIT),
+	}
+	jsn, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) { // nothing recorded yet
+		return &registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsn, &registry)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	if registry.Units == nil {
+		registry.Units = make(map[string]*ARBUNIT)
+	}
+	if goutils.Loglevel() > 1 {
+		goutils.Log.Printf("Loaded slot registry from %v", filename)
+	}
+	return &registry, nil
+}
+
+func (registry *SLOTREGISTRY) save() error {
+	if len(registry.filename) == 0 { // dry runs never write the registry
+		return nil
+	}
+	jsn, err := json.MarshalIndent(registry, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(registry.filename), 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so an interrupted write cannot corrupt the registry
+	tmpfile := registry.filename + ".tmp"
+	err = ioutil.WriteFile(tmpfile, jsn, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, registry.filename)
+}
+
+func (registry *SLOTREGISTRY) unit(serial string) *ARBUNIT {
+	unit, ok := registry.Units[serial]
+	if !ok {
+		unit = &ARBUNIT{}
+		registry.Units[serial] = unit
+	}
+	if unit.Slots == nil {
+		unit.Slots = make(map[uint]*ARBSLOT)
+	}
+	return unit
+}
+
+func (registry *SLOTREGISTRY) record(serial string, slot uint, source string, samples []int) error {
+	unit := registry.unit(serial)
+	unit.Free = removeSlot(unit.Free, slot) // the contents are known now
+	unit.Slots[slot] = &ARBSLOT{
+		Hash:     arbitraryWaveformHash(samples),
+		Source:   source,
+		Uploaded: time.Now(),
+		Samples:  samples,
+	}
+	return registry.save()
+}
+
+func (unit *ARBUNIT) isReserved(slot uint) bool {
+	return slotIn(slot, unit.Reserved)
+}
+
+func (unit *ARBUNIT) isFree(slot uint) bool {
+	return slotIn(slot, unit.Free)
+}
+
+func slotIn(slot uint, slots []uint) bool {
+	for _, v := range slots {
+		if v == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSlot returns slots without slot
+func removeSlot(slots []uint, slot uint) []uint {
+	kept := make([]uint, 0, len(slots))
+	for _, v := range slots {
+		if v != slot {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func (registry *SLOTREGISTRY) slot(serial string, slot uint) *ARBSLOT {
+	unit, ok := registry.Units[serial]
+	if !ok || unit.Slots == nil {
+		return nil
+	}
+	return unit.Slots[slot]
+}
+
+func (mhs5200 *MHS5200A) slotRegistry() (*SLOTREGISTRY, string, error) {
+	if mhs5200.registry == nil {
+		registry, err := loadSlotRegistry(slotRegistryFilename)
+		if err != nil {
+			return nil, "", err
+		}
+		if mhs5200.sim != nil {
+			registry.filename = ""
+		}
+		mhs5200.registry = registry
+	}
+	if len(mhs5200.serial) == 0 {
+		serial, err := mhs5200.GetSerial()
+		if err != nil {
+			return nil, "", err
+		}
+		mhs5200.serial = serial
+	}
+	return mhs5200.registry, mhs5200.serial, nil
+}
+
+// recordArbitraryWaveform stores an uploaded waveform in the slot registry
+func (mhs5200 *MHS5200A) recordArbitraryWaveform(slot uint, source string, samples []int) error {
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return err
+	}
+	return registry.record(serial, slot, source, samples)
+}
+
+// GetArbitraryWaveformSlot returns what the slot registry knows about slot, nil if nothing was recorded
+func (mhs5200 *MHS5200A) GetArbitraryWaveformSlot(slot uint) (*ARBSLOT, error) {
+	if slot >= ARB_WAVEFORM_NUM_SLOTS {
+		return nil, fmt.Errorf("%v is not a valid arbitrary waveform slot", slot)
+	}
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return registry.slot(serial, slot), nil
+}
+
+func (mhs5200 *MHS5200A) ShowArbitraryWaveformSlots() error {
+	registry, serial, err := mhs5200.slotRegistry()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Arbitrary waveforms for serial %v (%v)\n", serial, registry.filename)
+	unit, ok := registry.Units[serial]
+	if !ok || (len(unit.Slots) == 0 && len(unit.Reserved) == 0 && len(unit.Free) == 0) {
+		fmt.Printf("\tNo uploads recorded\n")
+		return nil
+	}
+	slots := make([]int, 0, len(unit.Slots))
+	for slot := uint(0); slot < ARB_WAVEFORM_NUM_SLOTS; slot++ {
+		if _, ok := unit.Slots[slot]; ok || unit.isReserved(slot) || unit.isFree(slot) {
+			slots = append(slots, int(slot))
+		}
+	}
+	for _, slot := range slots {
+		reserved := ""
+		if unit.isReserved(uint(slot)) {
+			reserved = " (reserved)"
+		} else if unit.isFree(uint(slot)) {
+			reserved = " (free)"
+		}
+		v, ok := unit.Slots[uint(slot)]
+		if !ok {
+			fmt.Printf("\tSlot %2d:%v\tunknown contents\n", slot, reserved)
+			continue
+		}
+		source := v.Source
+		if len(source) == 0 {
+			source = "unknown"
+		}
+		if len(v.Name) > 0 && v.Name != source {
+			source = v.Name + ", " + source
+		}
+		fmt.Printf("\tSlot %2d:%v\t%.16s\t%v\t%v\n", slot, reserved, v.Hash, v.Uploaded.Format(time.Stamp), source)
+	}
+	return nil
+}
+
+// DumpArbitraryWaveform writes the recorded contents of slot to filename, one sample per line in the -1.0 to 1.0 range
+func (mhs5200 *MHS5200A) DumpArbitraryWaveform(slot uint, filename string) error {
+	if len(filename) == 0 {
+		return fmt.Errorf("filename is empty")
+	}
+	v, err := mhs5200.GetArbitraryWaveformSlot(slot)
+	if err != nil {
+		return err
+	}
+	if v == nil || len(v.Samples) != ARB_WAVEFORM_NUM_POINTS {
+		return fmt.Errorf("No waveform has been recorded for slot %v", slot)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# slot %v, serial %v\n", slot, mhs5200.serial)
+	fmt.Fprintf(&b, "# source %v\n", v.Source)
+	fmt.Fprintf(&b, "# uploaded %v\n", v.Uploaded.Format(time.RFC3339))
+	fmt.Fprintf(&b, "# sha256 %v\n", v.Hash)
+	for _, sample := range v.Samples {
+		b.WriteString(strconv.FormatFloat(mhs5200.ArbitraryWaveformToNormalised(sample), 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+	return ioutil.WriteFile(filename, []byte(b.String()), 0644)
+}
@@ -0,0 +1,246 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"path/filepath"
+)
+
+const (
+	SPECTRUM_MAX_HARMONICS      = 32    // number of harmonics shown
+	SPECTRUM_SIGNIFICANT_DB     = -60.0 // harmonics below this level relative to the largest one are ignored
+	SPECTRUM_BANDWIDTH_FRACTION = 0.99  // fraction of the AC power used to define the effective bandwidth
+	SPECTRUM_PLOT_FLOOR_DB      = -100.0
+	SPECTRUM_PLOT_MAX_HARMONICS = 128
+)
+
+type HARMONIC struct {
+	N         int     `json:"n"`
+	Amplitude float64 `json:"amp"`
+	Phase     float64 `json:"phase,omitempty"` // degrees, relative to a sine
+}
+
+type SPECTRUM struct {
+	DC           float64
+	RMS          float64 // AC rms
+	Peak         float64 // AC peak
+	CrestFactor  float64
+	THD          float64 // percent, NaN if there is no significant fundamental
+	Harmonics    []HARMONIC
+	BandwidthN   int // number of harmonics containing SPECTRUM_BANDWIDTH_FRACTION of the AC power
+	LargestIndex int // index of the largest harmonic
+}
+
+// fft computes the discrete fourier transform of x in place, len(x) must be a power of 2
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ { // bit reversal permutation
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2.0*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a := x[start+k]
+				b := x[start+k+size/2] * wk
+				x[start+k] = a + b
+				x[start+k+size/2] = a - b
+				wk *= w
+			}
+		}
+	}
+}
+
+// analyseSpectrum computes the harmonic content of one cycle of a waveform
+func analyseSpectrum(data []float64) (*SPECTRUM, error) {
+	n := len(data)
+	if n == 0 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("spectral analysis needs a power of 2 number of samples, got %v", n)
+	}
+	x := make([]complex128, n)
+	for i, v := range data {
+		x[i] = complex(v, 0)
+	}
+	fft(x)
+	s := SPECTRUM{
+		DC:        real(x[0]) / float64(n),
+		Harmonics: make([]HARMONIC, n/2),
+	}
+	for k := 1; k <= n/2; k++ {
+		amp := 2.0 * cmplx.Abs(x[k]) / float64(n)
+		if k == n/2 { // nyquist bin is not mirrored
+			amp *= 0.5
+		}
+		phase := cmplx.Phase(x[k])*180.0/math.Pi + 90.0
+		phase = math.Mod(phase+360.0, 360.0)
+		if amp < 1e-12 || 360.0-phase < 1e-6 {
+			phase = 0.0
+		}
+		s.Harmonics[k-1] = HARMONIC{N: k, Amplitude: amp, Phase: phase}
+		if amp > s.Harmonics[s.LargestIndex].Amplitude {
+			s.LargestIndex = k - 1
+		}
+	}
+	power := 0.0
+	for _, v := range data {
+		d := v - s.DC
+		power += d * d
+		s.Peak = math.Max(s.Peak, math.Abs(d))
+	}
+	s.RMS = math.Sqrt(power / float64(n))
+	s.CrestFactor = math.NaN()
+	if s.RMS > 0.0 {
+		s.CrestFactor = s.Peak / s.RMS
+	}
+	s.THD = math.NaN()
+	distortion := 0.0
+	for _, h := range s.Harmonics[1:] {
+		distortion += h.Amplitude * h.Amplitude
+	}
+	if s.relativeDB(s.Harmonics[0].Amplitude) >= SPECTRUM_SIGNIFICANT_DB {
+		s.THD = 100.0 * math.Sqrt(distortion) / s.Harmonics[0].Amplitude
+	}
+	total := distortion + s.Harmonics[0].Amplitude*s.Harmonics[0].Amplitude
+	cumulative := 0.0
+	for _, h := range s.Harmonics {
+		cumulative += h.Amplitude * h.Amplitude
+		if cumulative >= SPECTRUM_BANDWIDTH_FRACTION*total {
+			s.BandwidthN = h.N
+			break
+		}
+	}
+	return &s, nil
+}
+
+// relativeDB returns the level of amplitude in dB relative to the largest harmonic
+func (s *SPECTRUM) relativeDB(amplitude float64) float64 {
+	largest := s.Harmonics[s.LargestIndex].Amplitude
+	if largest <= 0.0 || amplitude <= 0.0 {
+		return math.Inf(-1)
+	}
+	return 20.0 * math.Log10(amplitude/largest)
+}
+
+// showArbitraryWaveformSpectrum analyses the waveform in filename, as quantised by the generator, played back at frequency Hz
+func showArbitraryWaveformSpectrum(filename string, transforms []TRANSFORM, frequency float64, imagefile string) error {
+	if frequency <= 0.0 || frequency > 25.0e6 {
+		return fmt.Errorf("%v is not a valid frequency", frequency)
+	}
+	data, err := loadTransformedArbitraryWaveformFile(filename, transforms)
+	if err != nil {
+		return err
+	}
+	samples := quantiseArbitraryWaveform(data)
+	for i, v := range samples {
+		data[i] = arbitraryWaveformToNormalised(v)
+	}
+	s, err := analyseSpectrum(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Spectrum of %v at %v\n", filename, unitsString(frequency, "Hz", true))
+	fmt.Printf("\tDC:\t\t%.4f\n", s.DC)
+	fmt.Printf("\tRMS (AC):\t%.4f\n", s.RMS)
+	fmt.Printf("\tCrest factor:\t%.3f\n", s.CrestFactor)
+	if math.IsNaN(s.THD) {
+		fmt.Printf("\tTHD:\t\tn/a, the fundamental is not significant\n")
+	} else {
+		fmt.Printf("\tTHD:\t\t%.3f%%\n", s.THD)
+	}
+	fmt.Printf("\tBandwidth:\t%v (%v harmonics contain %.0f%% of the AC power)\n", unitsString(float64(s.BandwidthN)*frequency, "Hz", true), s.BandwidthN, SPECTRUM_BANDWIDTH_FRACTION*100.0)
+	fmt.Println("")
+	fmt.Printf("\tHarmonic\tFrequency\tAmplitude\tLevel\t\tPhase\n")
+	shown := 0
+	for _, h := range s.Harmonics {
+		db := s.relativeDB(h.Amplitude)
+		if db < SPECTRUM_SIGNIFICANT_DB {
+			continue
+		}
+		fmt.Printf("\t%d\t\t%v\t%.5f\t\t%.1f dB\t\t%.1f°\n", h.N, unitsString(float64(h.N)*frequency, "Hz", true), h.Amplitude, db, h.Phase)
+		shown++
+		if shown >= SPECTRUM_MAX_HARMONICS {
+			fmt.Printf("\t...\n")
+			break
+		}
+	}
+	fmt.Println("")
+	above := 0
+	for _, h := range s.Harmonics {
+		if float64(h.N)*frequency > ARB_WAVEFORM_MAX_FREQUENCY && s.relativeDB(h.Amplitude) >= SPECTRUM_SIGNIFICANT_DB {
+			above++
+		}
+	}
+	if above > 0 {
+		fmt.Printf("Warning: %v significant harmonics are above the %v arbitrary waveform bandwidth and will be attenuated\n", above, unitsString(ARB_WAVEFORM_MAX_FREQUENCY, "Hz", true))
+	}
+
+	nplot := SPECTRUM_PLOT_MAX_HARMONICS
+	if len(s.Harmonics) < nplot {
+		nplot = len(s.Harmonics)
+	}
+	plot := PLOT{
+		Title:  filepath.Base(filename) + " harmonics, dB relative to largest",
+		XLabel: "harmonic",
+		YLabel: "dB",
+		X:      make([]float64, nplot),
+		Y:      make([]float64, nplot),
+		Xmin:   0,
+		Xmax:   float64(nplot),
+		Ymin:   SPECTRUM_PLOT_FLOOR_DB,
+		Ymax:   0,
+		Bars:   true,
+	}
+	for i := 0; i < nplot; i++ {
+		plot.X[i] = float64(s.Harmonics[i].N)
+		plot.Y[i] = math.Max(SPECTRUM_PLOT_FLOOR_DB, s.relativeDB(s.Harmonics[i].Amplitude))
+	}
+	fmt.Print(plot.Terminal(PLOT_TERMINAL_WIDTH, PLOT_TERMINAL_HEIGHT))
+	if len(imagefile) > 0 {
+		return plot.WriteImage(imagefile)
+	}
+	return nil
+}
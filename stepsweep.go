@@ -0,0 +1,400 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	STEPSWEEP_DEFAULT_POINTS = 11  // points of a linear sweep
+	STEPSWEEP_DEFAULT_DECADE = 10  // points per decade of a logarithmic sweep
+	STEPSWEEP_DEFAULT_DB     = 1.0 // dB per step of a level sweep in dB
+)
+
+var stepSweepDirections = []string{"up", "down", "triangle"}
+
+// STEPSWEEP is a sweep stepped in software, on either channel, through a list of
+// frequencies or amplitudes, dwelling on each. The list is played count times in
+// the given direction, and the counter optionally measures at the end of every
+// dwell
+type STEPSWEEP struct {
+	ch        uint
+	param     string // frequency or amplitude
+	values    []float64
+	dwell     time.Duration
+	direction string
+	count     uint
+	measure   string // measurement type, empty for none
+	csvfile   string // file measurements are written to, empty for none
+}
+
+// linearValues returns points values evenly spaced from start to end
+func linearValues(start float64, end float64, points uint) []float64 {
+	if points < 2 {
+		return []float64{start}
+	}
+	v := make([]float64, points)
+	for i := range v {
+		v[i] = start + (end-start)*float64(i)/float64(points-1)
+	}
+	v[points-1] = end
+	return v
+}
+
+// ratioValues returns values from start to end, each ratio times the previous
+// one, the last step is shorter when end is not a whole step away
+func ratioValues(start float64, end float64, ratio float64) []float64 {
+	steps := math.Abs(math.Log(end/start) / math.Log(ratio))
+	n := int(math.Ceil(steps - PROFILE_TOLERANCE))
+	if end < start {
+		ratio = 1.0 / ratio
+	}
+	v := make([]float64, 0, n+1)
+	for i := 0; i < n; i++ {
+		v = append(v, start*math.Pow(ratio, float64(i)))
+	}
+	return append(v, end)
+}
+
+// stepSweepValues returns the values of one pass of a sweep of param, in the
+// order listed, from the values list or generated from startf to endf for
+// frequencies and from to to for amplitudes
+func stepSweepValues(param string, data *CMDPARAMS) ([]float64, error) {
+	var v []float64
+	var min, max float64
+	typ := "linear"
+	if data.Type != nil {
+		typ = *data.Type
+	}
+	switch param {
+	case "frequency":
+		min, max = 0.0, 25.0e6
+		if len(data.Values) > 0 {
+			v = append(v, data.Values...)
+			break
+		}
+		if data.Startf == nil || data.Endf == nil {
+			return nil, fmt.Errorf("needs startf and endf, or values")
+		}
+		switch sweepTypeStringToInt(typ) {
+		case SWEEP_LINEAR:
+			points := uint(STEPSWEEP_DEFAULT_POINTS)
+			if data.Points != nil {
+				points = *data.Points
+			}
+			v = linearValues(*data.Startf, *data.Endf, points)
+		case SWEEP_LOG:
+			if *data.Startf <= 0 || *data.Endf <= 0 {
+				return nil, fmt.Errorf("a logarithmic sweep cannot start or end at 0Hz")
+			}
+			perdecade := uint(STEPSWEEP_DEFAULT_DECADE)
+			if data.Decade != nil {
+				perdecade = *data.Decade
+			}
+			if perdecade == 0 {
+				return nil, fmt.Errorf("decade must be greater than 0")
+			}
+			v = ratioValues(*data.Startf, *data.Endf, math.Pow(10.0, 1.0/float64(perdecade)))
+		default:
+			return nil, fmt.Errorf("Unknown sweep type %v, valid types are linear and log", typ)
+		}
+
+	case "amplitude":
+		min, max = 5.0e-3, 20.0
+		if len(data.Values) > 0 {
+			v = append(v, data.Values...)
+			break
+		}
+		if data.From == nil || data.To == nil {
+			return nil, fmt.Errorf("needs from and to, or values")
+		}
+		if data.Step != nil && *data.Step <= 0 {
+			return nil, fmt.Errorf("step must be greater than 0")
+		}
+		switch typ {
+		case "linear":
+			points := uint(STEPSWEEP_DEFAULT_POINTS)
+			if data.Points != nil {
+				points = *data.Points
+			} else if data.Step != nil {
+				points = uint(math.Ceil(math.Abs(*data.To-*data.From)/(*data.Step)-PROFILE_TOLERANCE)) + 1
+			}
+			v = linearValues(*data.From, *data.To, points)
+		case "db":
+			db := STEPSWEEP_DEFAULT_DB
+			if data.Step != nil {
+				db = *data.Step
+			}
+			if *data.From <= 0 || *data.To <= 0 {
+				return nil, fmt.Errorf("a level sweep in dB cannot start or end at 0V")
+			}
+			v = ratioValues(*data.From, *data.To, math.Pow(10.0, db/20.0))
+		default:
+			return nil, fmt.Errorf("Unknown level sweep type %v, valid types are linear and db", typ)
+		}
+	}
+	for _, value := range v {
+		if value < min || value > max {
+			return nil, fmt.Errorf("%v is not a valid %v", value, param)
+		}
+	}
+	return v, nil
+}
+
+// checkStepSweep returns a function rejecting the parameters of a sweep of param
+// that cannot work
+func checkStepSweep(param string) func(data *CMDPARAMS) error {
+	return func(data *CMDPARAMS) error {
+		_, err := stepSweepValues(param, data)
+		if err != nil {
+			return err
+		}
+		if data.Dwell != nil {
+			d, err := parseDuration(*data.Dwell)
+			if err != nil {
+				return err
+			}
+			if data.Measure != nil && d < time.Duration(SCRIPT_MEASURE_INTERVAL*float64(time.Second)) {
+				return fmt.Errorf("dwell must be at least the %vs counter gate time to measure", SCRIPT_MEASURE_INTERVAL)
+			}
+		}
+		if data.Direction != nil && !stringIn(*data.Direction, stepSweepDirections) {
+			return fmt.Errorf("Unknown direction %v, valid directions are up, down and triangle", *data.Direction)
+		}
+		if data.Count != nil && *data.Count == 0 {
+			return fmt.Errorf("count must be greater than 0")
+		}
+		if data.Measure != nil && (!stringIn(*data.Measure, measureTypes) || *data.Measure == "stop" || *data.Measure == "off") {
+			return fmt.Errorf("Unknown measurement type %v", *data.Measure)
+		}
+		if data.File != nil && data.Measure == nil {
+			return fmt.Errorf("file needs a measure type to write")
+		}
+		return nil
+	}
+}
+
+// newStepSweep builds a sweep of param from the parameters of a sweep command
+func newStepSweep(ch uint, param string, data *CMDPARAMS) (*STEPSWEEP, error) {
+	err := checkStepSweep(param)(data)
+	if err != nil {
+		return nil, err
+	}
+	values, err := stepSweepValues(param, data)
+	if err != nil {
+		return nil, err
+	}
+	sweep := &STEPSWEEP{
+		ch:        ch,
+		param:     param,
+		values:    values,
+		direction: "up",
+		count:     1,
+	}
+	sweep.dwell, _ = parseDuration(*data.Dwell)
+	if data.Direction != nil {
+		sweep.direction = *data.Direction
+	}
+	if data.Count != nil {
+		sweep.count = *data.Count
+	}
+	if data.Measure != nil {
+		sweep.measure = *data.Measure
+	}
+	if data.File != nil {
+		sweep.csvfile = *data.File
+	}
+	return sweep, nil
+}
+
+// pass returns the values of one pass in the direction of the sweep
+func (sweep *STEPSWEEP) pass() []float64 {
+	v := append([]float64(nil), sweep.values...)
+	switch sweep.direction {
+	case "down":
+		for i, j := 0, len(v)-1; i < j; i, j = i+1, j-1 {
+			v[i], v[j] = v[j], v[i]
+		}
+	case "triangle":
+		for i := len(sweep.values) - 2; i >= 0; i-- {
+			v = append(v, sweep.values[i])
+		}
+	}
+	return v
+}
+
+// SetAmplitudeAuto sets the amplitude, switching the -20dB attenuator on at and
+// below 2V for millivolt resolution and off above it. The attenuator scales the
+// amplitude setting by 10, so the switch is ordered for the output to dip rather
+// than jump tenfold
+func (mhs5200 *MHS5200A) SetAmplitudeAuto(ch uint, v float64) error {
+	v, err := mhs5200.limitAmplitude(ch, v)
+	if err != nil {
+		return err
+	}
+	attenuation, err := mhs5200.GetAttenuation(ch)
+	if err != nil {
+		return err
+	}
+	want := uint(ATTENUATION_0DB)
+	if v <= ATTENUATED_MAX_AMPLITUDE {
+		want = ATTENUATION_MINUS_20DB
+	}
+	switch {
+	case attenuation == want:
+		return mhs5200.SetAmplitude(ch, v)
+
+	case want == ATTENUATION_0DB:
+		// set a tenth of the amplitude while attenuated, turning the attenuator off brings it up
+		err = mhs5200.SetAmplitude(ch, v/10.0)
+		if err != nil {
+			return err
+		}
+		return mhs5200.SetAttenuation(ch, ATTENUATION_0DB)
+	}
+	err = mhs5200.SetAttenuation(ch, ATTENUATION_MINUS_20DB)
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetAmplitude(ch, v)
+}
+
+// set sets the swept parameter
+func (sweep *STEPSWEEP) set(mhs5200 *MHS5200A, v float64) error {
+	if sweep.param == "amplitude" {
+		return mhs5200.SetAmplitudeAuto(sweep.ch, v)
+	}
+	return mhs5200.SetFrequency(sweep.ch, v)
+}
+
+// valueString formats a value of the swept parameter
+func (sweep *STEPSWEEP) valueString(mhs5200 *MHS5200A, v float64) string {
+	if sweep.param == "amplitude" {
+		return mhs5200.AmplitudeString(v)
+	}
+	return mhs5200.FrequencyString(v)
+}
+
+// StepSweep runs a software sweep. Each step is timed from the start of the
+// sweep, so the time taken to send commands and read the counter does not add up
+func (mhs5200 *MHS5200A) StepSweep(sweep *STEPSWEEP, progress func(string)) error {
+	var w *csv.Writer
+	if len(sweep.csvfile) > 0 {
+		f, err := os.Create(sweep.csvfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = csv.NewWriter(f)
+		defer w.Flush()
+		w.Write([]string{"pass", "step", "seconds", sweep.param, "measured " + sweep.measure})
+	}
+	if len(sweep.measure) > 0 {
+		err := mhs5200.selectMeasurement(sweep.measure)
+		if err != nil {
+			return err
+		}
+	}
+	pass := sweep.pass()
+	start := mhs5200.now()
+	step := 0
+	for n := uint(1); n <= sweep.count; n++ {
+		for i, value := range pass {
+			err := sweep.set(mhs5200, value)
+			if err != nil {
+				return err
+			}
+			step++
+			next := start.Add(sweep.dwell * time.Duration(step))
+			if wait := next.Sub(mhs5200.now()); wait > 0 {
+				mhs5200.sleep(wait)
+			}
+			msg := fmt.Sprintf("Pass %v/%v step %v/%v, channel %v at %v", n, sweep.count, i+1, len(pass), sweep.ch, sweep.valueString(mhs5200, value))
+			if len(sweep.measure) == 0 {
+				progress(msg)
+				continue
+			}
+			v, err := mhs5200.GetMeasurement()
+			if err != nil {
+				return err
+			}
+			progress(fmt.Sprintf("%v, %v %v", msg, sweep.measure, mhs5200.MeasurementString(v)))
+			if w != nil {
+				elapsed := mhs5200.now().Sub(start).Seconds()
+				w.Write([]string{
+					strconv.Itoa(int(n)),
+					strconv.Itoa(i + 1),
+					strconv.FormatFloat(elapsed, 'f', 3, 64),
+					strconv.FormatFloat(value, 'g', -1, 64),
+					strconv.FormatFloat(v, 'g', -1, 64),
+				})
+			}
+		}
+	}
+	if w != nil {
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// stepSweepCommand returns the Run function of the commands sweeping param
+func stepSweepCommand(param string) func(state *COMMANDSTATE, data *CMDPARAMS) error {
+	return func(state *COMMANDSTATE, data *CMDPARAMS) error {
+		sweep, err := newStepSweep(state.ch(data), param, data)
+		if err != nil {
+			return err
+		}
+		if state.mhs5200.sim != nil && len(sweep.csvfile) > 0 { // the readings are simulated
+			state.logf("Skipping writing the readings to %v", sweep.csvfile)
+			sweep.csvfile = ""
+		}
+		state.logf("Stepping channel %v %v through %v values, %v each", sweep.ch, param, len(sweep.pass()), sweep.dwell)
+		return state.mhs5200.StepSweep(sweep, func(msg string) {
+			if len(sweep.measure) > 0 {
+				state.printf("%v", msg)
+			} else {
+				state.logf("%v", msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// synthesiseHarmonics builds one 2048 sample cycle from a list of harmonics, scaled to use the full DAC range
+func synthesiseHarmonics(harmonics []HARMONIC) ([]float64, error) {
+	if len(harmonics) == 0 {
+		return nil, fmt.Errorf("no harmonics specified")
+	}
+	data := make([]float64, ARB_WAVEFORM_NUM_POINTS)
+	for _, h := range harmonics {
+		if h.N < 1 || h.N > ARB_WAVEFORM_NUM_POINTS/2 {
+			return nil, fmt.Errorf("%v is not a valid harmonic, valid harmonics are 1 to %v", h.N, ARB_WAVEFORM_NUM_POINTS/2)
+		}
+		if math.IsNaN(h.Amplitude) || math.IsInf(h.Amplitude, 0) || math.IsNaN(h.Phase) || math.IsInf(h.Phase, 0) {
+			return nil, fmt.Errorf("harmonic %v has an invalid amplitude or phase", h.N)
+		}
+		phase := h.Phase * math.Pi / 180.0
+		for i := range data {
+			data[i] += h.Amplitude * math.Sin(2.0*math.Pi*float64(h.N)*float64(i)/ARB_WAVEFORM_NUM_POINTS+phase)
+		}
+	}
+	peak := 0.0
+	for _, v := range data {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	if peak == 0.0 {
+		return nil, fmt.Errorf("all harmonics have zero amplitude")
+	}
+	for i := range data {
+		data[i] /= peak
+	}
+	return data, nil
+}
+
+// bandLimitedHarmonics returns the fourier series of a classic waveform, up to and including harmonic order
+func bandLimitedHarmonics(shape string, order uint) ([]HARMONIC, error) {
+	if order < 1 || order > ARB_WAVEFORM_NUM_POINTS/2 {
+		return nil, fmt.Errorf("%v is not a valid number of harmonics, valid values are 1 to %v", order, ARB_WAVEFORM_NUM_POINTS/2)
+	}
+	harmonics := make([]HARMONIC, 0)
+	for n := 1; n <= int(order); n++ {
+		h := HARMONIC{N: n}
+		switch shape {
+		case WAVEFORM_SINE_STR:
+			if n > 1 {
+				return harmonics, nil
+			}
+			h.Amplitude = 1.0
+
+		case WAVEFORM_SQUARE_STR:
+			if n%2 == 0 {
+				continue
+			}
+			h.Amplitude = 1.0 / float64(n)
+
+		case WAVEFORM_TRIANGLE_STR:
+			if n%2 == 0 {
+				continue
+			}
+			h.Amplitude = 1.0 / float64(n*n)
+			if n%4 == 3 {
+				h.Phase = 180.0
+			}
+
+		case WAVEFORM_RISING_SAWTOOTH_STR, "sawtooth":
+			h.Amplitude = 1.0 / float64(n)
+			if n%2 == 0 {
+				h.Phase = 180.0
+			}
+
+		case WAVEFORM_DESCENDING_SAWTOOTH_STR:
+			h.Amplitude = 1.0 / float64(n)
+			if n%2 == 1 {
+				h.Phase = 180.0
+			}
+
+		default:
+			return nil, fmt.Errorf("%v is not a valid band limited waveform. Valid names are sine, square, triangle, rising sawtooth, descending sawtooth", shape)
+		}
+		harmonics = append(harmonics, h)
+	}
+	return harmonics, nil
+}
+
+// parseHarmonics parses a JSON list of harmonics, either given directly or read from a file
+func parseHarmonics(spec string) ([]HARMONIC, error) {
+	jsn := []byte(spec)
+	if !strings.HasPrefix(strings.TrimSpace(spec), "[") {
+		var err error
+		jsn, err = ioutil.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	harmonics := make([]HARMONIC, 0)
+	err := json.Unmarshal(jsn, &harmonics)
+	if err != nil {
+		return nil, err
+	}
+	return harmonics, nil
+}
+
+func harmonicsString(harmonics []HARMONIC) string {
+	s := make([]string, len(harmonics))
+	for i, h := range harmonics {
+		s[i] = fmt.Sprintf("%d:%g", h.N, h.Amplitude)
+		if h.Phase != 0.0 {
+			s[i] += fmt.Sprintf("@%g", h.Phase)
+		}
+	}
+	return "harmonics " + strings.Join(s, ",")
+}
+
+// SetArbitraryWaveformFromHarmonics synthesises a waveform from harmonics, uploads it to slot and selects it on channel ch
+func (mhs5200 *MHS5200A) SetArbitraryWaveformFromHarmonics(ch uint, slot uint, harmonics []HARMONIC, source string) error {
+	data, err := synthesiseHarmonics(harmonics)
+	if err != nil {
+		return err
+	}
+	if len(source) == 0 {
+		source = harmonicsString(harmonics)
+	}
+	err = mhs5200.setArbitraryWaveform(slot, data, source)
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetWaveform(ch, WAVEFORM_ARB_0+slot)
+}
+
+// SetBandLimitedWaveform uploads a band limited version of a classic waveform to slot and selects it on channel ch
+func (mhs5200 *MHS5200A) SetBandLimitedWaveform(ch uint, slot uint, shape string, order uint) error {
+	harmonics, err := bandLimitedHarmonics(shape, order)
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetArbitraryWaveformFromHarmonics(ch, slot, harmonics, fmt.Sprintf("band limited %v, %v harmonics", shape, order))
+}
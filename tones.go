@@ -0,0 +1,306 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MORSE_DEFAULT_WPM  = 20.0
+	MORSE_DEFAULT_TONE = 700.0                  // Hz
+	DTMF_DEFAULT_TONE  = 100 * time.Millisecond // length of each digit
+	DTMF_DEFAULT_GAP   = 100 * time.Millisecond // silence between digits
+)
+
+// morseCode is the international morse code of the characters morse can send
+var morseCode = map[rune]string{
+	'A': ".-", 'B': "-...", 'C': "-.-.", 'D': "-..", 'E': ".", 'F': "..-.",
+	'G': "--.", 'H': "....", 'I': "..", 'J': ".---", 'K': "-.-", 'L': ".-..",
+	'M': "--", 'N': "-.", 'O': "---", 'P': ".--.", 'Q': "--.-", 'R': ".-.",
+	'S': "...", 'T': "-", 'U': "..-", 'V': "...-", 'W': ".--", 'X': "-..-",
+	'Y': "-.--", 'Z': "--..",
+	'0': "-----", '1': ".----", '2': "..---", '3': "...--", '4': "....-",
+	'5': ".....", '6': "-....", '7': "--...", '8': "---..", '9': "----.",
+	'.': ".-.-.-", ',': "--..--", '?': "..--..", '\'': ".----.", '!': "-.-.--",
+	'/': "-..-.", '(': "-.--.", ')': "-.--.-", '&': ".-...", ':': "---...",
+	';': "-.-.-.", '=': "-...-", '+': ".-.-.", '-': "-....-", '_': "..--.-",
+	'"': ".-..-.", '$': "...-..-", '@': ".--.-.",
+}
+
+// dtmfTones are the low and high group frequencies of each DTMF digit
+var dtmfTones = map[rune][2]float64{
+	'1': {697, 1209}, '2': {697, 1336}, '3': {697, 1477}, 'A': {697, 1633},
+	'4': {770, 1209}, '5': {770, 1336}, '6': {770, 1477}, 'B': {770, 1633},
+	'7': {852, 1209}, '8': {852, 1336}, '9': {852, 1477}, 'C': {852, 1633},
+	'*': {941, 1209}, '0': {941, 1336}, '#': {941, 1477}, 'D': {941, 1633},
+}
+
+// TONESTEP is one step of a tone sequence, the outputs on with the channels at the
+// frequencies of freqs, indexed by channel - 1 and 0 when unchanged, or off
+type TONESTEP struct {
+	on    bool
+	freqs [2]float64
+	d     time.Duration
+}
+
+// morseSteps returns the tone sequence of text sent at wpm words per minute. A dot
+// lasts 1.2/wpm seconds, the PARIS standard, a dash 3 dots, and the gaps between
+// elements, characters and words 1, 3 and 7 dots
+func morseSteps(text string, wpm float64) ([]TONESTEP, error) {
+	dot := time.Duration(1.2 / wpm * float64(time.Second))
+	steps := make([]TONESTEP, 0)
+	gap := func(dots time.Duration) {
+		if len(steps) == 0 {
+			return
+		}
+		if last := &steps[len(steps)-1]; !last.on {
+			if last.d < dots*dot {
+				last.d = dots * dot
+			}
+			return
+		}
+		steps = append(steps, TONESTEP{d: dots * dot})
+	}
+	for _, c := range strings.ToUpper(text) {
+		if c == ' ' {
+			gap(7)
+			continue
+		}
+		code, ok := morseCode[c]
+		if !ok {
+			return nil, fmt.Errorf("%q has no morse code", c)
+		}
+		gap(3)
+		for i, e := range code {
+			if i > 0 {
+				gap(1)
+			}
+			d := dot
+			if e == '-' {
+				d = 3 * dot
+			}
+			steps = append(steps, TONESTEP{on: true, d: d})
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("nothing to send")
+	}
+	return steps, nil
+}
+
+// dtmfSteps returns the tone sequence of digits, the low group tone on channel 1 and
+// the high group tone on channel 2, each digit lasting tone followed by gap
+func dtmfSteps(digits string, tone time.Duration, gap time.Duration) ([]TONESTEP, error) {
+	steps := make([]TONESTEP, 0)
+	for _, c := range strings.ToUpper(digits) {
+		if c == ' ' {
+			continue
+		}
+		freqs, ok := dtmfTones[c]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a DTMF digit, valid digits are 0-9, A-D, * and #", c)
+		}
+		steps = append(steps, TONESTEP{on: true, freqs: freqs, d: tone}, TONESTEP{d: gap})
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("nothing to send")
+	}
+	return steps, nil
+}
+
+// setToneFrequencies sets the frequencies of a tone step while the outputs are off
+func (mhs5200 *MHS5200A) setToneFrequencies(step *TONESTEP) error {
+	for i, f := range step.freqs {
+		if f > 0 {
+			err := mhs5200.SetFrequency(uint(i+1), f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PlayTones plays a tone sequence, turning the outputs on and off. The frequencies
+// of each tone are set during the silence before it, and the steps are timed from
+// the start so the time taken by the commands does not add up. The outputs are off
+// when the sequence ends
+func (mhs5200 *MHS5200A) PlayTones(steps []TONESTEP, stats *KEYINGSTATS) error {
+	err := mhs5200.SetOnOff(false)
+	if err != nil {
+		return err
+	}
+	err = mhs5200.setToneFrequencies(&steps[0])
+	if err != nil {
+		return err
+	}
+	start := mhs5200.now()
+	due := start
+	for i := range steps {
+		if wait := due.Sub(mhs5200.now()); wait > 0 {
+			mhs5200.sleep(wait)
+		}
+		err = mhs5200.SetOnOff(steps[i].on)
+		if err != nil {
+			return err
+		}
+		stats.latency(mhs5200, due)
+		if !steps[i].on && i+1 < len(steps) {
+			err = mhs5200.setToneFrequencies(&steps[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		due = due.Add(steps[i].d)
+		stats.symbols++
+	}
+	if wait := due.Sub(mhs5200.now()); wait > 0 {
+		mhs5200.sleep(wait)
+	}
+	if steps[len(steps)-1].on {
+		err = mhs5200.SetOnOff(false)
+		if err != nil {
+			return err
+		}
+	}
+	stats.elapsed = mhs5200.now().Sub(start)
+	return nil
+}
+
+// checkMorse rejects morse parameters that cannot work
+func checkMorse(data *CMDPARAMS) error {
+	if data.Channel != nil && (*data.Channel < 1 || *data.Channel > 2) {
+		return fmt.Errorf("%v is not a valid channel", *data.Channel)
+	}
+	if data.Wpm != nil && *data.Wpm <= 0 {
+		return fmt.Errorf("wpm must be greater than 0")
+	}
+	if data.Tone != nil && (*data.Tone <= 0 || *data.Tone > 25.0e6) {
+		return fmt.Errorf("%v is not a valid frequency", *data.Tone)
+	}
+	if data.Text != nil {
+		_, err := morseSteps(*data.Text, MORSE_DEFAULT_WPM)
+		return err
+	}
+	return nil
+}
+
+// morseCommand sends text in morse code on a tone on the current channel
+func morseCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	err := checkMorse(data)
+	if err != nil {
+		return err
+	}
+	wpm := MORSE_DEFAULT_WPM
+	if data.Wpm != nil {
+		wpm = *data.Wpm
+	}
+	tone := MORSE_DEFAULT_TONE
+	if data.Tone != nil {
+		tone = *data.Tone
+	}
+	steps, err := morseSteps(*data.Text, wpm)
+	if err != nil {
+		return err
+	}
+	ch := state.ch(data)
+	steps[0].freqs[ch-1] = tone
+	state.logf("Sending %q in morse at %v wpm on a %vHz tone on channel %v", *data.Text, wpm, tone, ch)
+	var stats KEYINGSTATS
+	err = state.mhs5200.PlayTones(steps, &stats)
+	if err != nil {
+		return err
+	}
+	state.printf("Sent %v elements and gaps in %v, %v", stats.symbols, stats.elapsed.Round(time.Millisecond), stats.latencyString())
+	return nil
+}
+
+// checkDTMF rejects dtmf parameters that cannot work
+func checkDTMF(data *CMDPARAMS) error {
+	for _, d := range []*string{data.Duration, data.Gap} {
+		if d != nil {
+			v, err := parseDuration(*d)
+			if err != nil {
+				return err
+			}
+			if v <= 0 {
+				return fmt.Errorf("%v must be longer than 0", *d)
+			}
+		}
+	}
+	if data.Digits != nil {
+		_, err := dtmfSteps(*data.Digits, DTMF_DEFAULT_TONE, DTMF_DEFAULT_GAP)
+		return err
+	}
+	return nil
+}
+
+// dtmfCommand dials digits, the two tones of each on channels 1 and 2 set to sine
+func dtmfCommand(state *COMMANDSTATE, data *CMDPARAMS) error {
+	err := checkDTMF(data)
+	if err != nil {
+		return err
+	}
+	tone := DTMF_DEFAULT_TONE
+	if data.Duration != nil {
+		tone, _ = parseDuration(*data.Duration)
+	}
+	gap := DTMF_DEFAULT_GAP
+	if data.Gap != nil {
+		gap, _ = parseDuration(*data.Gap)
+	}
+	steps, err := dtmfSteps(*data.Digits, tone, gap)
+	if err != nil {
+		return err
+	}
+	state.logf("Dialling %v, %v tones %v apart", *data.Digits, tone, gap)
+	for ch := uint(1); ch <= 2; ch++ { // DTMF tones are pure sines
+		err = state.mhs5200.SetWaveform(ch, WAVEFORM_SINE)
+		if err != nil {
+			return err
+		}
+	}
+	var stats KEYINGSTATS
+	err = state.mhs5200.PlayTones(steps, &stats)
+	if err != nil {
+		return err
+	}
+	state.printf("Dialled %v digits in %v, %v", len(steps)/2, stats.elapsed.Round(time.Millisecond), stats.latencyString())
+	return nil
+}
@@ -0,0 +1,361 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/peterska/go-utils"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/* Arbitrary waveform transforms
+*
+* Transforms are applied in order to a loaded waveform before it is uploaded. Filters and
+* shifts treat the waveform as one cycle of a periodic signal, so they wrap around.
+*
+ */
+
+const (
+	TRANSFORM_LOWPASS_TAPS = 127
+)
+
+type TRANSFORM struct {
+	Op    string  `json:"op"`
+	Value float64 `json:"value,omitempty"`
+	File  string  `json:"file,omitempty"` // waveform used by mix and concat
+	Name  string  `json:"name,omitempty"` // window function name
+}
+
+// transformNeedsValue returns the kind of parameter an operation takes, "" if it takes none
+func transformNeedsValue(op string) (string, error) {
+	switch op {
+	case "invert", "reverse", "normalise":
+		return "", nil
+
+	case "dc", "gain", "clip", "lowpass", "smooth", "rotate", "phase", "repeat":
+		return "value", nil
+
+	case "window":
+		return "name", nil
+
+	case "mix", "concat":
+		return "file", nil
+	}
+	return "", fmt.Errorf("%v is not a valid transform. Valid transforms are invert, reverse, normalise, dc, gain, clip, lowpass, smooth, window, rotate, phase, repeat, mix, concat", op)
+}
+
+// parseTransforms parses --op [value] command line options, returning the transforms and the number of arguments used
+func parseTransforms(args []string) ([]TRANSFORM, int, error) {
+	transforms := make([]TRANSFORM, 0)
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "--") {
+		t := TRANSFORM{Op: strings.TrimPrefix(args[i], "--")}
+		i++
+		kind, err := transformNeedsValue(t.Op)
+		if err != nil {
+			return nil, i, err
+		}
+		if len(kind) > 0 {
+			if i >= len(args) {
+				return nil, i, fmt.Errorf("Not enough parameters for --%v", t.Op)
+			}
+			switch kind {
+			case "value":
+				t.Value, err = strconv.ParseFloat(args[i], 64)
+				if err != nil {
+					return nil, i, err
+				}
+
+			case "name":
+				t.Name = args[i]
+
+			case "file":
+				t.File = args[i]
+			}
+			i++
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, i, nil
+}
+
+func transformsString(transforms []TRANSFORM) string {
+	s := make([]string, len(transforms))
+	for i, t := range transforms {
+		s[i] = "--" + t.Op
+		kind, _ := transformNeedsValue(t.Op)
+		switch kind {
+		case "value":
+			s[i] += " " + strconv.FormatFloat(t.Value, 'g', -1, 64)
+
+		case "name":
+			s[i] += " " + t.Name
+
+		case "file":
+			s[i] += " " + t.File
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// resample stretches or squashes one cycle of data to n samples using linear interpolation
+func resample(data []float64, n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		x := float64(i) * float64(len(data)) / float64(n)
+		j := int(x)
+		frac := x - float64(j)
+		out[i] = data[j]*(1.0-frac) + data[(j+1)%len(data)]*frac
+	}
+	return out
+}
+
+// circularConvolve filters one cycle of data with a symmetric, odd length kernel
+func circularConvolve(data []float64, kernel []float64) []float64 {
+	n := len(data)
+	half := len(kernel) / 2
+	out := make([]float64, n)
+	for i := range out {
+		sum := 0.0
+		for k, c := range kernel {
+			sum += c * data[((i+k-half)%n+n)%n]
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+// lowpassKernel returns a blackman windowed sinc filter with a cutoff of fc times the sample rate
+func lowpassKernel(fc float64) []float64 {
+	kernel := make([]float64, TRANSFORM_LOWPASS_TAPS)
+	m := float64(TRANSFORM_LOWPASS_TAPS - 1)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i) - m/2.0
+		v := 2.0 * fc
+		if x != 0.0 {
+			v = math.Sin(2.0*math.Pi*fc*x) / (math.Pi * x)
+		}
+		v *= 0.42 - 0.5*math.Cos(2.0*math.Pi*float64(i)/m) + 0.08*math.Cos(4.0*math.Pi*float64(i)/m)
+		kernel[i] = v
+		sum += v
+	}
+	for i := range kernel { // unity gain at DC
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+func windowFunction(name string, i int, n int) (float64, error) {
+	x := 2.0 * math.Pi * float64(i) / float64(n-1)
+	switch name {
+	case "hann", "hanning":
+		return 0.5 - 0.5*math.Cos(x), nil
+
+	case "hamming":
+		return 0.54 - 0.46*math.Cos(x), nil
+
+	case "blackman":
+		return 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2.0*x), nil
+
+	case "triangle", "bartlett":
+		return 1.0 - math.Abs(2.0*float64(i)/float64(n-1)-1.0), nil
+	}
+	return 0.0, fmt.Errorf("%v is not a valid window. Valid windows are hann, hamming, blackman, triangle", name)
+}
+
+func applyTransform(data []float64, t TRANSFORM) ([]float64, error) {
+	n := len(data)
+	out := make([]float64, n)
+	switch t.Op {
+	case "invert":
+		for i, v := range data {
+			out[i] = -v
+		}
+
+	case "reverse":
+		for i, v := range data {
+			out[n-1-i] = v
+		}
+
+	case "normalise":
+		minval, maxval := data[0], data[0]
+		for _, v := range data {
+			minval = math.Min(minval, v)
+			maxval = math.Max(maxval, v)
+		}
+		if minval == maxval {
+			return nil, fmt.Errorf("cannot normalise a constant waveform")
+		}
+		for i, v := range data {
+			out[i] = ARB_WAVEFORM_INPUT_MIN + (v-minval)*(ARB_WAVEFORM_INPUT_MAX-ARB_WAVEFORM_INPUT_MIN)/(maxval-minval)
+		}
+
+	case "dc":
+		for i, v := range data {
+			out[i] = v + t.Value
+		}
+
+	case "gain":
+		for i, v := range data {
+			out[i] = v * t.Value
+		}
+
+	case "clip":
+		if t.Value <= 0.0 {
+			return nil, fmt.Errorf("%v is not a valid clip level", t.Value)
+		}
+		for i, v := range data {
+			out[i] = math.Max(-t.Value, math.Min(t.Value, v))
+		}
+
+	case "lowpass":
+		if t.Value <= 0.0 || t.Value >= 0.5 {
+			return nil, fmt.Errorf("%v is not a valid cutoff, use a fraction of the sample rate between 0 and 0.5", t.Value)
+		}
+		out = circularConvolve(data, lowpassKernel(t.Value))
+
+	case "smooth":
+		width := int(t.Value)
+		if width < 1 || width > n {
+			return nil, fmt.Errorf("%v is not a valid number of samples to smooth over", t.Value)
+		}
+		if width%2 == 0 { // keep the filter centred
+			width++
+		}
+		kernel := make([]float64, width)
+		for i := range kernel {
+			kernel[i] = 1.0 / float64(width)
+		}
+		out = circularConvolve(data, kernel)
+
+	case "window":
+		for i, v := range data {
+			w, err := windowFunction(t.Name, i, n)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v * w
+		}
+
+	case "rotate", "phase":
+		shift := int(math.Round(t.Value))
+		if t.Op == "phase" {
+			shift = int(math.Round(t.Value * float64(n) / 360.0))
+		}
+		for i, v := range data {
+			out[((i+shift)%n+n)%n] = v
+		}
+
+	case "repeat":
+		count := int(t.Value)
+		if count < 1 || count > n/2 {
+			return nil, fmt.Errorf("%v is not a valid repeat count", t.Value)
+		}
+		cycle := resample(data, n/count)
+		for i := range out {
+			out[i] = cycle[i%len(cycle)]
+		}
+
+	case "mix", "concat":
+		other, err := loadArbitraryWaveformFile(t.File)
+		if err != nil {
+			return nil, err
+		}
+		if t.Op == "mix" {
+			for i := range out {
+				out[i] = (data[i] + other[i]) * 0.5
+			}
+		} else {
+			out = append(resample(data, n/2), resample(other, n-n/2)...)
+		}
+
+	default:
+		_, err := transformNeedsValue(t.Op)
+		return nil, err
+	}
+	return out, nil
+}
+
+// applyTransforms runs data through transforms in order, clipping the result to the arbitrary waveform range
+func applyTransforms(data []float64, transforms []TRANSFORM) ([]float64, error) {
+	var err error
+	for _, t := range transforms {
+		data, err = applyTransform(data, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	clipped := 0
+	for i, v := range data {
+		if v > ARB_WAVEFORM_INPUT_MAX || v < ARB_WAVEFORM_INPUT_MIN {
+			data[i] = math.Max(ARB_WAVEFORM_INPUT_MIN, math.Min(ARB_WAVEFORM_INPUT_MAX, v))
+			clipped++
+		}
+	}
+	if clipped > 0 {
+		goutils.Log.Printf("Warning: %v samples were clipped to the -1.0 to 1.0 range, use --normalise to rescale instead", clipped)
+	}
+	return data, nil
+}
+
+// loadTransformedArbitraryWaveformFile loads filename and applies transforms to it
+func loadTransformedArbitraryWaveformFile(filename string, transforms []TRANSFORM) ([]float64, error) {
+	data, err := loadArbitraryWaveformFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return applyTransforms(data, transforms)
+}
+
+// SetTransformedArbitraryWaveformFromFile uploads filename, after applying transforms, to slot and selects it on channel ch
+func (mhs5200 *MHS5200A) SetTransformedArbitraryWaveformFromFile(ch uint, slot uint, filename string, transforms []TRANSFORM) error {
+	data, err := loadTransformedArbitraryWaveformFile(filename, transforms)
+	if err != nil {
+		return err
+	}
+	source := filename
+	if len(transforms) > 0 {
+		source += " " + transformsString(transforms)
+	}
+	err = mhs5200.setArbitraryWaveform(slot, data, source)
+	if err != nil {
+		return err
+	}
+	return mhs5200.SetWaveform(ch, WAVEFORM_ARB_0+slot)
+}
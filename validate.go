@@ -0,0 +1,410 @@
+/*
+ * cmdline utility to configure and control the MHS-5200A series for function generators
+ *
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2020 - 2021, Peter Skarpetis
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VALIDATE_STEP_LIMIT caps the steps and loop iterations of the simulated run, so a
+// script that runs for days or never ends does not hang -validate
+const VALIDATE_STEP_LIMIT = 1000000
+
+// scriptFlowCommands lists the flow control commands only scripts have with their
+// required parameters, A|B means either A or B is required. The other commands
+// come from the command registry
+var scriptFlowCommands = map[string][]string{
+	"repeat":  {"count|seconds"},
+	"foreach": {"values", "param|var"},
+	"call":    {"name"},
+	"set":     {"name", "value"},
+	"if":      {"condition"},
+	"assert":  {"condition|value"},
+}
+
+// scriptCommand returns the required parameters of a script command and whether
+// scripts have the command
+func scriptCommand(name string) ([]string, bool) {
+	if required, ok := scriptFlowCommands[name]; ok {
+		return required, true
+	}
+	c := findCommand(name)
+	if c == nil || c.CommandOnly {
+		return nil, false
+	}
+	return c.required(), true
+}
+
+// scriptRanges are the valid ranges of numeric script parameters
+var scriptRanges = map[string][2]float64{
+	"channel":   {1, 2},
+	"frequency": {0, 25.0e6},
+	"startf":    {0, 25.0e6},
+	"endf":      {0, 25.0e6},
+	"amplitude": {5.0e-3, 20.0},
+	"duty":      {0, 99.9},
+	"phase":     {0, 360},
+	"slot":      {0, ARB_WAVEFORM_NUM_SLOTS - 1},
+	"samples":   {1, math.MaxUint32},
+	"interval":  {0, math.MaxFloat64},
+	"ppm":       {0, math.MaxFloat64},
+	"percent":   {0, math.MaxFloat64},
+	"tolerance": {0, math.MaxFloat64},
+}
+
+var measureTypes = []string{"frequency", "count", "period", "pulsewidth", "negativepulsewidth", "duty", "stop", "off"}
+
+// SCRIPTLINTER checks a script without running it. vars holds the script variables
+// with their -set overrides, assigned additionally every variable the script can
+// assign at run time, with a placeholder value
+type SCRIPTLINTER struct {
+	script   *SCRIPT
+	vars     map[string]float64
+	assigned map[string]float64
+	called   map[string]bool
+	params   map[string]bool
+	errors   []string
+	warnings []string
+}
+
+func (linter *SCRIPTLINTER) errorf(format string, a ...interface{}) {
+	linter.errors = append(linter.errors, fmt.Sprintf(format, a...))
+}
+
+func (linter *SCRIPTLINTER) warningf(format string, a ...interface{}) {
+	linter.warnings = append(linter.warnings, fmt.Sprintf(format, a...))
+}
+
+// collectAssigned records the variables assigned by set, foreach, repeat and measure
+func (linter *SCRIPTLINTER) collectAssigned(cmds []CMD) {
+	for _, cmd := range cmds {
+		var entries []map[string]interface{}
+		if json.Unmarshal(cmd.Data, &entries) == nil {
+			for _, entry := range entries {
+				for _, key := range []string{"var", "name"} {
+					if key == "name" && cmd.Cmd != "set" {
+						continue
+					}
+					if name, ok := entry[key].(string); ok && validVariableName(name) {
+						if _, ok := linter.assigned[name]; !ok {
+							linter.assigned[name] = math.Pi // unlikely to cause a division by zero
+						}
+					}
+				}
+			}
+		}
+		linter.collectAssigned(cmd.Cmds)
+		linter.collectAssigned(cmd.Else)
+	}
+}
+
+// expandEntry expands the expressions of one data entry using vars
+func expandEntry(raw []byte, vars map[string]float64) (map[string]interface{}, error) {
+	var entry interface{}
+	err := json.Unmarshal(raw, &entry)
+	if err != nil {
+		return nil, err
+	}
+	player := SCRIPTPLAYER{vars: vars}
+	expanded, err := player.expand(entry)
+	if err != nil {
+		return nil, err
+	}
+	return expanded.(map[string]interface{}), nil
+}
+
+// lintEntry checks one data entry of a command
+func (linter *SCRIPTLINTER) lintEntry(loc string, cmd CMD, entry map[string]interface{}) {
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !linter.params[key] {
+			linter.errorf("%v: unknown parameter %v", loc, key)
+		}
+	}
+	requiredParams, _ := scriptCommand(cmd.Cmd)
+	for _, required := range requiredParams {
+		found := false
+		for _, alternative := range strings.Split(required, "|") {
+			if _, ok := entry[alternative]; ok {
+				found = true
+			}
+		}
+		if !found {
+			linter.errorf("%v: needs %v", loc, strings.Replace(required, "|", " or ", -1))
+		}
+	}
+
+	// expressions using only script variables are checked with their real values,
+	// those using variables assigned at run time only for syntax and types
+	raw, _ := json.Marshal(entry)
+	exact := true
+	expanded, err := expandEntry(raw, linter.vars)
+	if err != nil {
+		exact = false
+		expanded, err = expandEntry(raw, linter.assigned)
+		if err != nil {
+			if !errors.Is(err, errExprDivisionByZero) {
+				linter.errorf("%v: %v", loc, err)
+			}
+			return
+		}
+	}
+	jsn, _ := json.Marshal(expanded)
+	var params CMDPARAMS
+	err = json.Unmarshal(jsn, &params)
+	if err != nil {
+		linter.errorf("%v: %v", loc, err)
+		return
+	}
+	if exact {
+		for _, key := range keys {
+			rng, ok := scriptRanges[key]
+			v, isnum := expanded[key].(float64)
+			if ok && isnum && (v < rng[0] || v > rng[1]) {
+				linter.errorf("%v: %v %v is outside [%v, %v]", loc, key, v, rng[0], rng[1])
+			}
+		}
+	}
+	if params.Waveform != nil && waveformStringToInt(*params.Waveform) == math.MaxUint32 && !isLibraryWaveform(*params.Waveform) {
+		linter.errorf("%v: unknown waveform %v", loc, *params.Waveform)
+	}
+	if params.Type != nil {
+		switch cmd.Cmd {
+		case "measure":
+			known := false
+			for _, t := range measureTypes {
+				known = known || t == *params.Type
+			}
+			if !known {
+				linter.errorf("%v: unknown measurement type %v", loc, *params.Type)
+			}
+		case "configsweep", "sweeptype", "stepsweep":
+			if sweepTypeStringToInt(*params.Type) == math.MaxUint32 {
+				linter.errorf("%v: unknown sweep type %v", loc, *params.Type)
+			}
+		}
+	}
+	if c := findCommand(cmd.Cmd); c != nil && c.Check != nil && exact {
+		if err := c.Check(&params); err != nil {
+			linter.errorf("%v: %v", loc, err)
+		}
+	}
+	if c := findCommand(cmd.Cmd); params.File != nil && exact && (c == nil || !c.WritesFile) {
+		if _, err := os.Stat(*params.File); err != nil {
+			linter.errorf("%v: %v", loc, err)
+		}
+	}
+	if cmd.Cmd == "repeat" && exact && params.Seconds == nil && params.Count != nil && *params.Count == 0 {
+		linter.errorf("%v: count 0 without seconds never ends", loc)
+	}
+	if cmd.Cmd == "call" && params.Name != nil {
+		if _, ok := linter.script.Subs[*params.Name]; !ok {
+			linter.errorf("%v: unknown subroutine %v", loc, *params.Name)
+		}
+		linter.called[*params.Name] = true
+	}
+}
+
+// lintSchedule checks the at and clock times of a command
+func (linter *SCRIPTLINTER) lintSchedule(loc string, cmd CMD) {
+	if len(cmd.At) > 0 && len(cmd.Clock) > 0 {
+		linter.errorf("%v: at and clock cannot both be given", loc)
+	}
+	if len(cmd.At) > 0 {
+		at, err := expandExpressions(cmd.At, linter.assigned)
+		if err == nil {
+			_, err = parseOffset(at)
+		}
+		if err != nil && !errors.Is(err, errExprDivisionByZero) {
+			linter.errorf("%v: %v", loc, err)
+		}
+	}
+	if len(cmd.Clock) > 0 {
+		_, err := parseClock(cmd.Clock, time.Now())
+		if err != nil {
+			linter.errorf("%v: %v", loc, err)
+		}
+	}
+}
+
+// lint checks a list of commands and the bodies of their loops and branches
+func (linter *SCRIPTLINTER) lint(cmds []CMD, where string) {
+	for i, cmd := range cmds {
+		loc := fmt.Sprintf("%v[%v] %v", where, i, cmd.Cmd)
+		requiredParams, ok := scriptCommand(cmd.Cmd)
+		if !ok {
+			linter.errorf("%v: unknown command %v", loc, cmd.Cmd)
+			continue
+		}
+		linter.lintSchedule(loc, cmd)
+		switch cmd.Cmd {
+		case "repeat", "foreach":
+			if len(cmd.Else) > 0 {
+				linter.warningf("%v: else is only used by if", loc)
+			}
+		case "if":
+		default:
+			if len(cmd.Cmds) > 0 || len(cmd.Else) > 0 {
+				linter.warningf("%v: cmds and else are only used by repeat, foreach and if", loc)
+			}
+		}
+		var entries []map[string]interface{}
+		if len(cmd.Data) > 0 {
+			err := json.Unmarshal(cmd.Data, &entries)
+			if err != nil {
+				linter.errorf("%v: data must be an array of objects, %v", loc, err)
+				continue
+			}
+		}
+		if len(entries) == 0 && len(requiredParams) > 0 {
+			linter.errorf("%v: needs %v", loc, strings.Replace(strings.Join(requiredParams, ", "), "|", " or ", -1))
+		}
+		for _, entry := range entries {
+			linter.lintEntry(loc, cmd, entry)
+		}
+		linter.lint(cmd.Cmds, loc+" cmds")
+		linter.lint(cmd.Else, loc+" else")
+	}
+}
+
+// validateScript checks every command of a script, including loop bodies, branches
+// and subroutines that may never run, then plays it against a silent simulator to
+// catch run time errors and estimate how long it takes
+func validateScript(scriptfile string, port string) error {
+	script, err := loadScript(scriptfile, true, nil)
+	if err != nil {
+		return err
+	}
+	if len(script.Port) == 0 {
+		script.Port = port
+	}
+	player := SCRIPTPLAYER{script: script}
+	err = player.initVars()
+	if err != nil {
+		return fmt.Errorf("%v: %v", scriptfile, err)
+	}
+	linter := SCRIPTLINTER{
+		script:   script,
+		vars:     player.vars,
+		assigned: make(map[string]float64),
+		called:   make(map[string]bool),
+		params:   make(map[string]bool),
+	}
+	t := reflect.TypeOf(CMDPARAMS{})
+	for i := 0; i < t.NumField(); i++ {
+		linter.params[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	for name, value := range linter.vars {
+		linter.assigned[name] = value
+	}
+	if len(script.AutoRamp) > 0 {
+		if _, err := parseDuration(script.AutoRamp); err != nil {
+			linter.errorf("autoramp: %v", err)
+		}
+	}
+	linter.collectAssigned(script.Cmds)
+	names := make([]string, 0, len(script.Subs))
+	for name, sub := range script.Subs {
+		linter.collectAssigned(sub)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	linter.lint(script.Cmds, "cmds")
+	for _, name := range names {
+		linter.lint(script.Subs[name], "subs."+name)
+	}
+	for _, name := range names {
+		if !linter.called[name] && !script.included[name] {
+			linter.warningf("subs.%v: never called", name)
+		}
+	}
+
+	// a failed assert is expected when the counter readings are simulated
+	estimate := time.Duration(0)
+	commands := 0
+	profile, err := selectProfile(script.Profile)
+	if err != nil {
+		linter.errorf("profile: %v", err)
+	}
+	if len(linter.errors) == 0 {
+		sim := NewSimulatedMHS5200A(false)
+		sim.SetProfile(profile)
+		stdout := os.Stdout
+		devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			os.Stdout = devnull
+		}
+		simulated := newScriptPlayer(sim, script, scriptfile)
+		simulated.stepLimit = VALIDATE_STEP_LIMIT
+		err = simulated.play()
+		os.Stdout = stdout
+		if devnull != nil {
+			devnull.Close()
+		}
+		sim.Close()
+		if err == errStepLimit {
+			linter.warningf("dry run stopped after %v steps, the estimated runtime only covers them", VALIDATE_STEP_LIMIT)
+		} else if err != nil && err != errFatalAssert {
+			linter.errorf("dry run: %v", err)
+		}
+		commands, estimate = sim.DryRunStatistics()
+	}
+
+	for _, e := range linter.errors {
+		fmt.Printf("error: %v\n", e)
+	}
+	for _, w := range linter.warnings {
+		fmt.Printf("warning: %v\n", w)
+	}
+	fmt.Printf("%v: %v errors, %v warnings\n", scriptfile, len(linter.errors), len(linter.warnings))
+	if len(linter.errors) > 0 {
+		return fmt.Errorf("%v is not valid", scriptfile)
+	}
+	fmt.Printf("Estimated runtime %v, %v device commands\n", estimate.Round(time.Second), commands)
+	return nil
+}